@@ -0,0 +1,75 @@
+// Package backoff implements exponential backoff with jitter for
+// retrying operations against Coder Cloud.
+package backoff
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy configures the delay between attempts. The zero value retries
+// immediately and forever.
+type Policy struct {
+	// Initial is the delay before the first retry.
+	Initial time.Duration
+	// Max caps the delay. Zero means no cap.
+	Max time.Duration
+	// Multiplier is applied to the delay after every attempt. Values
+	// below 1 are treated as 1.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction in either
+	// direction, e.g. 0.2 yields delays within ±20%.
+	Jitter float64
+	// MaxAttempts is the number of retries after which Next gives up.
+	// Zero means retry forever.
+	MaxAttempts int
+}
+
+// Backoff tracks the retries made under a Policy. It is not safe for
+// concurrent use.
+type Backoff struct {
+	Policy  Policy
+	attempt int
+}
+
+// New returns a Backoff following the policy.
+func New(p Policy) *Backoff {
+	return &Backoff{Policy: p}
+}
+
+// Next returns the delay to wait before the next retry. It returns
+// false once MaxAttempts retries have been made.
+func (b *Backoff) Next() (time.Duration, bool) {
+	p := b.Policy
+	if p.MaxAttempts > 0 && b.attempt >= p.MaxAttempts {
+		return 0, false
+	}
+
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+
+	delay := float64(p.Initial) * math.Pow(mult, float64(b.attempt))
+	if p.Max > 0 && delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	b.attempt++
+
+	return time.Duration(delay), true
+}
+
+// Attempt returns the number of retries made since the last Reset.
+func (b *Backoff) Attempt() int {
+	return b.attempt
+}
+
+// Reset starts over from the initial delay, e.g. after an operation
+// succeeded.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
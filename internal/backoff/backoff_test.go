@@ -0,0 +1,122 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func delays(b *Backoff, n int) []time.Duration {
+	var ds []time.Duration
+	for i := 0; i < n; i++ {
+		d, ok := b.Next()
+		if !ok {
+			break
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+func TestNext(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy Policy
+		want   []time.Duration
+	}{
+		{
+			name:   "growth",
+			policy: Policy{Initial: time.Second, Multiplier: 2},
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:   "cap",
+			policy: Policy{Initial: time.Second, Max: 3 * time.Second, Multiplier: 2},
+			want:   []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{
+			name:   "constant",
+			policy: Policy{Initial: time.Second, Multiplier: 1},
+			want:   []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			name:   "multiplier below one",
+			policy: Policy{Initial: time.Second, Multiplier: 0.5},
+			want:   []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			name:   "max attempts",
+			policy: Policy{Initial: time.Second, Multiplier: 2, MaxAttempts: 2},
+			want:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:   "zero value",
+			policy: Policy{},
+			want:   []time.Duration{0, 0, 0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := delays(New(tc.policy), len(tc.want)+1)
+			if tc.policy.MaxAttempts == 0 {
+				got = got[:len(tc.want)]
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("got %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	b := New(Policy{Initial: time.Second, Jitter: 0.2})
+
+	var varied bool
+	for i := 0; i < 1000; i++ {
+		d, _ := b.Next()
+		if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("delay %v outside ±20%% of 1s", d)
+		}
+		if d != time.Second {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Fatal("jitter didn't vary the delay")
+	}
+}
+
+func TestJitterCap(t *testing.T) {
+	// Jitter applies after the cap, so delays may exceed Max by the
+	// jitter fraction but no more.
+	b := New(Policy{Initial: time.Second, Max: 2 * time.Second, Multiplier: 10, Jitter: 0.5})
+	for i := 0; i < 100; i++ {
+		d, _ := b.Next()
+		if d > 3*time.Second {
+			t.Fatalf("delay %v exceeds the jittered cap", d)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	b := New(Policy{Initial: time.Second, Multiplier: 2, MaxAttempts: 2})
+	delays(b, 2)
+	if _, ok := b.Next(); ok {
+		t.Fatal("Next succeeded after MaxAttempts")
+	}
+	if b.Attempt() != 2 {
+		t.Fatalf("got attempt %d, want 2", b.Attempt())
+	}
+
+	b.Reset()
+	if b.Attempt() != 0 {
+		t.Fatalf("got attempt %d after reset", b.Attempt())
+	}
+	d, ok := b.Next()
+	if !ok || d != time.Second {
+		t.Fatalf("got %v, %v after reset, want the initial delay", d, ok)
+	}
+}
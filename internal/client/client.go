@@ -1,10 +1,50 @@
 package client
 
 import (
+	"context"
+	"net/http"
 	"net/url"
+
+	"nhooyr.io/websocket"
 )
 
 type Client struct {
 	Token   string
 	BaseURL *url.URL
+	// HTTPClient is used for REST requests and to dial websockets. It
+	// allows configuring transports, timeouts and instrumentation in
+	// one place. http.DefaultClient is used if it is nil.
+	HTTPClient *http.Client
+	// Retry configures how idempotent requests are retried.
+	// DefaultRetryPolicy is used if it is nil.
+	Retry *RetryPolicy
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// dial opens a websocket to the URL using the client's HTTP client.
+// Failed handshakes are turned into API errors.
+func (c *Client) dial(ctx context.Context, u string, header http.Header) (*websocket.Conn, error) {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("User-Agent", userAgent())
+
+	conn, resp, err := websocket.Dial(ctx, u, &websocket.DialOptions{ //nolint:bodyclose
+		HTTPClient: c.httpClient(),
+		HTTPHeader: header,
+	})
+	if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, bodyError(resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
 }
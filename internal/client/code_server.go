@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -8,11 +9,11 @@ import (
 	"golang.org/x/xerrors"
 )
 
-func (c *Client) CodeServer(id string) (*CodeServer, error) {
+func (c *Client) CodeServer(ctx context.Context, id string) (*CodeServer, error) {
 	path := fmt.Sprintf("/api/servers/%v", id)
 
 	var response CodeServer
-	err := c.requestBody("GET", path, nil, &response)
+	err := c.requestBody(ctx, "GET", path, nil, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -24,11 +25,11 @@ type AccessURLResponse struct {
 	URL string `json:"url"`
 }
 
-func (c *Client) AccessURL(id string) (string, error) {
+func (c *Client) AccessURL(ctx context.Context, id string) (string, error) {
 	path := fmt.Sprintf("/api/servers/%v/access-url", id)
 
 	var response AccessURLResponse
-	err := c.requestBody("GET", path, nil, &response)
+	err := c.requestBody(ctx, "GET", path, nil, &response)
 	if err != nil {
 		return "", err
 	}
@@ -52,15 +53,17 @@ type RegisterServerRequest struct {
 	Hostname string `json:"hostname"`
 }
 
-func (c *Client) RegisterCodeServer(name string) (*CodeServer, error) {
+func (c *Client) RegisterCodeServer(ctx context.Context, name string) (*CodeServer, error) {
 	const path = "/api/servers"
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, xerrors.Errorf("get hostname: %w", err)
 	}
 
+	// Registering is documented to be idempotent, a server with the
+	// name is returned if it already exists.
 	var response CodeServer
-	err = c.requestBody("POST", path,
+	err = c.idempotentRequestBody(ctx, "POST", path,
 		&RegisterServerRequest{
 			Name:     name,
 			Hostname: hostname,
@@ -73,3 +76,49 @@ func (c *Client) RegisterCodeServer(name string) (*CodeServer, error) {
 
 	return &response, nil
 }
+
+// ListCodeServers returns the servers registered to the user's account.
+func (c *Client) ListCodeServers(ctx context.Context) ([]CodeServer, error) {
+	const path = "/api/servers"
+
+	var response []CodeServer
+	err := c.requestBody(ctx, "GET", path, nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// DeleteCodeServer unregisters the server. Agents bound to it are
+// disconnected and its access URL stops working.
+func (c *Client) DeleteCodeServer(ctx context.Context, id string) error {
+	path := fmt.Sprintf("/api/servers/%v", id)
+
+	return c.requestBody(ctx, "DELETE", path, nil, nil)
+}
+
+// RenameServerRequest is the request body sent in a
+// rename server request.
+type RenameServerRequest struct {
+	Name string `json:"name"`
+}
+
+// RenameCodeServer changes the name of the server. Its ID and access URL
+// stay the same.
+func (c *Client) RenameCodeServer(ctx context.Context, id, name string) (*CodeServer, error) {
+	path := fmt.Sprintf("/api/servers/%v", id)
+
+	var response CodeServer
+	err := c.requestBody(ctx, "PATCH", path,
+		&RenameServerRequest{
+			Name: name,
+		},
+		&response,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
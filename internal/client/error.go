@@ -0,0 +1,152 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrUnauthorized is returned when Coder Cloud rejects the session
+// token, e.g. because it expired or was revoked.
+var ErrUnauthorized = xerrors.New("session token rejected")
+
+// ErrNotFound is returned when the requested resource doesn't exist,
+// e.g. because the server was deleted.
+var ErrNotFound = xerrors.New("not found")
+
+// ErrRateLimited is returned when Coder Cloud asks the agent to slow
+// down.
+var ErrRateLimited = xerrors.New("rate limited")
+
+// requestIDHeader is the header Coder Cloud identifies each request
+// with in its logs.
+const requestIDHeader = "X-Request-Id"
+
+// maxErrorBody caps how much of a response body that isn't an API error
+// is kept in an Error.
+const maxErrorBody = 512
+
+// Error is returned for responses Coder Cloud answers with an unexpected
+// status code.
+type Error struct {
+	StatusCode int
+	// Message is the message of the API error in the body. It is empty
+	// if the body wasn't an API error, e.g. because a load balancer
+	// answered the request.
+	Message string
+	// Body is the start of the body if it wasn't an API error.
+	Body      string
+	Method    string
+	Path      string
+	RequestID string
+	// RetryAfter is the delay the Retry-After header asks for before
+	// sending the request again.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.Path != "" {
+		fmt.Fprintf(&b, "%s %s: ", e.Method, e.Path)
+	}
+	fmt.Fprintf(&b, "%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	switch {
+	case e.Message != "":
+		fmt.Fprintf(&b, ": %s", e.Message)
+	case e.Body != "":
+		fmt.Fprintf(&b, ": %q", e.Body)
+	}
+	if e.RequestID != "" {
+		fmt.Fprintf(&b, " (request id %s)", e.RequestID)
+	}
+	return b.String()
+}
+
+// Is makes errors.Is match the sentinel errors for the status code.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// IsUnauthorized reports whether err was caused by Coder Cloud
+// rejecting the session token.
+func IsUnauthorized(err error) bool {
+	return xerrors.Is(err, ErrUnauthorized)
+}
+
+// IsNotFound reports whether err was caused by the requested resource
+// not existing.
+func IsNotFound(err error) bool {
+	return xerrors.Is(err, ErrNotFound)
+}
+
+// IsRateLimited reports whether err was caused by Coder Cloud rate
+// limiting the agent.
+func IsRateLimited(err error) bool {
+	return xerrors.Is(err, ErrRateLimited)
+}
+
+// StatusCode returns the status code of the response that caused err,
+// or 0 if it wasn't caused by an unexpected response.
+func StatusCode(err error) int {
+	var apiErr *Error
+	if xerrors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+type apiError struct {
+	Err struct {
+		Msg string `json:"msg"`
+	} `json:"error"`
+}
+
+// bodyError reads the body of an unexpected response into an Error.
+func bodyError(resp *http.Response) error {
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get(requestIDHeader),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	if resp.Request != nil {
+		e.Method = resp.Request.Method
+		e.Path = resp.Request.URL.Path
+	}
+
+	// Bound the read in case the body is a large page.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	var apiErr apiError
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Err.Msg != "" {
+		e.Message = apiErr.Err.Msg
+		return e
+	}
+
+	e.Body = truncate(strings.TrimSpace(string(body)), maxErrorBody)
+	return e
+}
+
+// truncate shortens s to at most n bytes without splitting a rune.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/xerrors"
+)
+
+func TestBodyError(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		header map[string]string
+		body   string
+		want   Error
+		// wantMsg is a substring of the error message.
+		wantMsg string
+	}{
+		{
+			name:    "api error",
+			status:  http.StatusNotFound,
+			body:    `{"error": {"msg": "server not found"}}`,
+			want:    Error{StatusCode: http.StatusNotFound, Message: "server not found"},
+			wantMsg: "GET /api/servers/abc: 404 Not Found: server not found",
+		},
+		{
+			name:    "html 502",
+			status:  http.StatusBadGateway,
+			header:  map[string]string{"Content-Type": "text/html"},
+			body:    "<html><body><h1>502 Bad Gateway</h1></body></html>\n",
+			want:    Error{StatusCode: http.StatusBadGateway, Body: "<html><body><h1>502 Bad Gateway</h1></body></html>"},
+			wantMsg: `502 Bad Gateway: "<html>`,
+		},
+		{
+			name:   "json without message",
+			status: http.StatusInternalServerError,
+			body:   `{"error": {}}`,
+			want:   Error{StatusCode: http.StatusInternalServerError, Body: `{"error": {}}`},
+		},
+		{
+			name:    "empty body",
+			status:  http.StatusServiceUnavailable,
+			want:    Error{StatusCode: http.StatusServiceUnavailable},
+			wantMsg: "503 Service Unavailable",
+		},
+		{
+			name:    "request id",
+			status:  http.StatusInternalServerError,
+			header:  map[string]string{requestIDHeader: "req-123"},
+			body:    `{"error": {"msg": "internal error"}}`,
+			want:    Error{StatusCode: http.StatusInternalServerError, Message: "internal error", RequestID: "req-123"},
+			wantMsg: "(request id req-123)",
+		},
+		{
+			name:   "retry after",
+			status: http.StatusTooManyRequests,
+			header: map[string]string{"Retry-After": "30"},
+			want:   Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 30 * time.Second},
+		},
+		{
+			name:   "long body",
+			status: http.StatusBadGateway,
+			body:   strings.Repeat("é", maxErrorBody),
+			want:   Error{StatusCode: http.StatusBadGateway, Body: strings.Repeat("é", maxErrorBody/2) + "..."},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			for k, v := range tc.header {
+				rec.Header().Set(k, v)
+			}
+			rec.WriteHeader(tc.status)
+			rec.WriteString(tc.body)
+			resp := rec.Result()
+			resp.Request = httptest.NewRequest(http.MethodGet, "/api/servers/abc", nil)
+
+			err := bodyError(resp)
+			var got *Error
+			if !xerrors.As(err, &got) {
+				t.Fatalf("got %T, want *Error", err)
+			}
+			tc.want.Method, tc.want.Path = http.MethodGet, "/api/servers/abc"
+			if *got != tc.want {
+				t.Fatalf("got %+v, want %+v", *got, tc.want)
+			}
+			if !strings.Contains(err.Error(), tc.wantMsg) {
+				t.Fatalf("got message %q, want it to contain %q", err, tc.wantMsg)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{in: "short", n: 10, want: "short"},
+		{in: "exactly", n: 7, want: "exactly"},
+		{in: "too long", n: 3, want: "too..."},
+		// "é" is 2 bytes and "世" is 3, neither may be split.
+		{in: "éé", n: 3, want: "é..."},
+		{in: "a世界", n: 2, want: "a..."},
+		{in: "a世界", n: 4, want: "a世..."},
+		{in: "世界", n: 1, want: "..."},
+	} {
+		got := truncate(tc.in, tc.n)
+		if got != tc.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tc.in, tc.n, got, tc.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q, which isn't valid UTF-8", tc.in, tc.n, got)
+		}
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		target error
+		want   bool
+	}{
+		{status: http.StatusUnauthorized, target: ErrUnauthorized, want: true},
+		{status: http.StatusForbidden, target: ErrUnauthorized, want: true},
+		{status: http.StatusNotFound, target: ErrUnauthorized},
+		{status: http.StatusNotFound, target: ErrNotFound, want: true},
+		{status: http.StatusGone, target: ErrNotFound},
+		{status: http.StatusTooManyRequests, target: ErrRateLimited, want: true},
+		{status: http.StatusServiceUnavailable, target: ErrRateLimited},
+		{status: http.StatusInternalServerError, target: xerrors.New("other")},
+	} {
+		// Callers see errors wrapped with context.
+		err := xerrors.Errorf("get server: %w", &Error{StatusCode: tc.status})
+		if got := xerrors.Is(err, tc.target); got != tc.want {
+			t.Errorf("Is(%d, %v) = %v, want %v", tc.status, tc.target, got, tc.want)
+		}
+	}
+
+	if !IsUnauthorized(&Error{StatusCode: http.StatusForbidden}) || IsNotFound(&Error{StatusCode: http.StatusForbidden}) {
+		t.Error("helpers disagree with Is")
+	}
+	if StatusCode(xerrors.Errorf("wrapped: %w", &Error{StatusCode: http.StatusBadGateway})) != http.StatusBadGateway {
+		t.Error("StatusCode didn't unwrap the error")
+	}
+	if StatusCode(xerrors.New("no response")) != 0 {
+		t.Error("StatusCode of an error without a response isn't 0")
+	}
+}
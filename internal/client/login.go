@@ -3,8 +3,8 @@ package client
 import (
 	"context"
 	"io/ioutil"
-	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/pkg/browser"
 	"golang.org/x/xerrors"
@@ -19,34 +19,14 @@ func init() {
 	browser.Stdout = ioutil.Discard
 }
 
-// Login performs the login flow for an agent. It returns the resulting
-// session token to use for authenticated routes.
-func Login(addr, serverName string) (string, error) {
-	ctx := context.Background()
+// Login performs the login flow for an agent against the client's
+// BaseURL. It returns the resulting session token to use for
+// authenticated routes.
+func (c *Client) Login(ctx context.Context, serverName string) (string, error) {
+	ctx, cancel := withDefaultTimeout(ctx, DefaultLoginTimeout)
+	defer cancel()
 
-	u, err := url.Parse(addr)
-	if err != nil {
-		return "", err
-	}
-
-	query := url.Values{}
-	query.Add(agentlogin.ServerNameQueryParam, serverName)
-
-	loginURL := &url.URL{
-		Scheme:   u.Scheme,
-		Host:     u.Host,
-		Path:     "/login",
-		RawQuery: query.Encode(),
-	}
-
-	conn, resp, err := websocket.Dial(ctx, loginURL.String(), &websocket.DialOptions{
-		HTTPHeader: http.Header{
-			"User-Agent": []string{userAgent()},
-		},
-	})
-	if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
-		return "", bodyError(resp)
-	}
+	conn, err := c.dialLogin(ctx, serverName, "")
 	if err != nil {
 		return "", err
 	}
@@ -74,3 +54,64 @@ func Login(addr, serverName string) (string, error) {
 
 	return token, nil
 }
+
+// LoginDevice performs the device code login flow for an agent. It is
+// meant for machines without a browser: a short code is printed which
+// the user enters on another device. It returns the resulting session
+// token to use for authenticated routes.
+func (c *Client) LoginDevice(ctx context.Context, serverName string) (string, error) {
+	// The wait for the user is bounded by the expiry of the code rather
+	// than DefaultLoginTimeout.
+	dialCtx, cancel := withDefaultTimeout(ctx, DefaultDialTimeout)
+	defer cancel()
+
+	conn, err := c.dialLogin(dialCtx, serverName, agentlogin.ModeDevice)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close(websocket.StatusInternalError, "")
+
+	code, err := (&agentlogin.Client{Ctx: dialCtx, Conn: conn}).ReadDeviceCode()
+	if err != nil {
+		return "", xerrors.Errorf("read device code: %w", err)
+	}
+	if code.ExpiresAt.IsZero() {
+		code.ExpiresAt = time.Now().Add(DefaultLoginTimeout)
+	}
+
+	client := &agentlogin.Client{
+		Ctx:  ctx,
+		Conn: conn,
+	}
+
+	flog.Info("visit %s and enter the code %s to login", code.VerificationURL, code.UserCode)
+	flog.Info("the code expires in %s", time.Until(code.ExpiresAt).Round(time.Second))
+
+	token, err := client.WaitSessionToken(code)
+	if err != nil {
+		return "", xerrors.Errorf("wait for session token: %w", err)
+	}
+
+	return token, nil
+}
+
+// dialLogin opens the login websocket. An empty mode selects the
+// browser flow.
+func (c *Client) dialLogin(ctx context.Context, serverName, mode string) (*websocket.Conn, error) {
+	u := c.BaseURL
+
+	query := url.Values{}
+	query.Add(agentlogin.ServerNameQueryParam, serverName)
+	if mode != "" {
+		query.Add(agentlogin.ModeQueryParam, mode)
+	}
+
+	loginURL := &url.URL{
+		Scheme:   u.Scheme,
+		Host:     u.Host,
+		Path:     "/login",
+		RawQuery: query.Encode(),
+	}
+
+	return c.dial(ctx, loginURL.String(), nil)
+}
@@ -2,7 +2,6 @@ package client
 
 import (
 	"context"
-	"net/url"
 	"time"
 
 	"golang.org/x/xerrors"
@@ -19,19 +18,18 @@ type pingMsg struct {
 // Ping determines the websocket latency of the agent connection
 // to the server. A value of true is returned if the latency is
 // tolerable.
-func Ping(baseURL string) (time.Duration, bool, error) {
-	var ctx = context.Background()
+func (c *Client) Ping(ctx context.Context) (time.Duration, bool, error) {
+	ctx, cancel := withDefaultTimeout(ctx, DefaultTimeout)
+	defer cancel()
 
-	uri, err := url.Parse(baseURL)
-	if err != nil {
-		return 0, false, xerrors.Errorf("parse url: %w", err)
-	}
+	uri := *c.BaseURL
 	uri.Path = "/latency"
 
-	conn, _, err := websocket.Dial(context.Background(), uri.String(), nil)
+	conn, err := c.dial(ctx, uri.String(), nil)
 	if err != nil {
 		return 0, false, xerrors.Errorf("dial server: %w", err)
 	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
 
 	var msg pingMsg
 	err = wsjson.Read(ctx, conn, &msg)
@@ -9,21 +9,20 @@ import (
 	"nhooyr.io/websocket"
 )
 
+// ProxyAgent opens the websocket Coder Cloud proxies IDE connections
+// for the server over. ctx only bounds opening the websocket.
 func (c *Client) ProxyAgent(ctx context.Context, id string) (*websocket.Conn, error) {
-	ws, resp, err := websocket.Dial(ctx, //nolint:bodyclose
+	ctx, cancel := withDefaultTimeout(ctx, DefaultDialTimeout)
+	defer cancel()
+
+	ws, err := c.dial(ctx,
 		fmt.Sprintf("%v/proxy/ide/%v/server",
 			c.BaseURL.String(),
 			id,
 		),
-		&websocket.DialOptions{
-			HTTPHeader: http.Header{
-				"User-Agent":  []string{userAgent()},
-				sessionHeader: []string{c.Token},
-			},
+		http.Header{
+			sessionHeader: []string{c.Token},
 		})
-	if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
-		return nil, bodyError(resp)
-	}
 	if err != nil {
 		return nil, xerrors.Errorf("dial cproxy: %w", err)
 	}
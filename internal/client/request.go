@@ -2,9 +2,11 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
+	"time"
 
 	"go.coder.com/cloud-agent/internal/version"
 	"golang.org/x/xerrors"
@@ -14,7 +16,28 @@ const (
 	sessionHeader = "Session-Token"
 )
 
-func (c *Client) request(method, path string, body interface{}) (*http.Response, error) {
+// Default timeouts applied to calls whose context has no deadline, so a
+// hung endpoint can't block the agent forever.
+const (
+	// DefaultTimeout bounds REST calls.
+	DefaultTimeout = 30 * time.Second
+	// DefaultDialTimeout bounds opening websockets.
+	DefaultDialTimeout = 30 * time.Second
+	// DefaultLoginTimeout bounds the login flows, which wait for the
+	// user, unless the device code says when it expires.
+	DefaultLoginTimeout = 10 * time.Minute
+)
+
+// withDefaultTimeout returns a context bounded by timeout unless ctx
+// already has a deadline.
+func withDefaultTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (c *Client) request(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
 	var rd io.Reader
 	if body != nil {
 		b, err := json.Marshal(body)
@@ -24,7 +47,7 @@ func (c *Client) request(method, path string, body interface{}) (*http.Response,
 		rd = bytes.NewReader(b)
 	}
 
-	req, err := http.NewRequest(method, c.BaseURL.String()+path, rd)
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL.String()+path, rd)
 	if err != nil {
 		return nil, xerrors.Errorf("new request: %w", err)
 	}
@@ -32,20 +55,45 @@ func (c *Client) request(method, path string, body interface{}) (*http.Response,
 	req.Header.Set(sessionHeader, c.Token)
 	req.Header.Set("User-Agent", userAgent())
 
-	return http.DefaultClient.Do(req)
+	return c.httpClient().Do(req)
+}
+
+// requestBody sends a request and decodes the response into response.
+// GET requests are retried after transient failures.
+func (c *Client) requestBody(ctx context.Context, method, path string, request, response interface{}) error {
+	if method != http.MethodGet {
+		return c.requestBodyOnce(ctx, method, path, request, response)
+	}
+	return c.idempotentRequestBody(ctx, method, path, request, response)
+}
+
+// idempotentRequestBody is like requestBody but retries the request
+// after transient failures regardless of its method.
+func (c *Client) idempotentRequestBody(ctx context.Context, method, path string, request, response interface{}) error {
+	return c.retry(ctx, func() error {
+		return c.requestBodyOnce(ctx, method, path, request, response)
+	})
 }
 
-func (c *Client) requestBody(method, path string, request, response interface{}) error {
-	resp, err := c.request(method, path, request)
+func (c *Client) requestBodyOnce(ctx context.Context, method, path string, request, response interface{}) error {
+	// The timeout must also cover reading the body.
+	ctx, cancel := withDefaultTimeout(ctx, DefaultTimeout)
+	defer cancel()
+
+	resp, err := c.request(ctx, method, path, request)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+	if resp.StatusCode != 200 && resp.StatusCode != 201 && resp.StatusCode != 204 {
 		return bodyError(resp)
 	}
 
+	if response == nil {
+		return nil
+	}
+
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
 		return xerrors.Errorf("unmarshal response: %w", err)
@@ -53,23 +101,6 @@ func (c *Client) requestBody(method, path string, request, response interface{})
 	return nil
 }
 
-type apiError struct {
-	Err struct {
-		Msg string `json:"msg"`
-	} `json:"error"`
-}
-
-func bodyError(resp *http.Response) error {
-	var apiErr apiError
-
-	err := json.NewDecoder(resp.Body).Decode(&apiErr)
-	if err != nil {
-		return xerrors.Errorf("decode err: %w", err)
-	}
-
-	return xerrors.New(apiErr.Err.Msg)
-}
-
 func userAgent() string {
 	return "CoderCloud/" + version.Version
 }
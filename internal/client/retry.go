@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cloud-agent/internal/backoff"
+)
+
+// RetryPolicy configures how idempotent requests are retried after
+// transient failures such as connection resets, 5xx responses and rate
+// limiting.
+type RetryPolicy struct {
+	backoff.Policy
+	// MaxElapsed caps the time spent on a request across all attempts.
+	// Zero means no cap.
+	MaxElapsed time.Duration
+}
+
+// DefaultRetryPolicy is used by clients without a RetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	Policy: backoff.Policy{
+		Initial:     500 * time.Millisecond,
+		Max:         10 * time.Second,
+		Multiplier:  2,
+		Jitter:      0.2,
+		MaxAttempts: 5,
+	},
+	MaxElapsed: 2 * time.Minute,
+}
+
+func (c *Client) retryPolicy() RetryPolicy {
+	if c.Retry != nil {
+		return *c.Retry
+	}
+	return DefaultRetryPolicy
+}
+
+// retry calls fn until it succeeds, fails permanently or the retry
+// policy gives up. Rate limited and unavailable responses are retried no
+// sooner than their Retry-After header asks for.
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	var (
+		policy = c.retryPolicy()
+		b      = backoff.New(policy.Policy)
+		start  = time.Now()
+	)
+	for {
+		err := fn()
+		if err == nil || !temporary(ctx, err) {
+			return err
+		}
+
+		delay, ok := b.Next()
+		if !ok {
+			return err
+		}
+		if after := retryAfter(err); after > delay {
+			delay = after
+		}
+		if policy.MaxElapsed > 0 && time.Since(start)+delay > policy.MaxElapsed {
+			return err
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return &gaveUpError{err: err, ctxErr: ctx.Err()}
+		case <-t.C:
+		}
+	}
+}
+
+// gaveUpError is returned when the caller gives up on a request while
+// it waits to be retried. It wraps the last error, so its status can
+// still be checked, and matches the context's error with xerrors.Is so
+// the request is known to have been canceled.
+type gaveUpError struct {
+	err    error
+	ctxErr error
+}
+
+func (e *gaveUpError) Error() string {
+	return fmt.Sprintf("gave up retrying (%v): %v", e.ctxErr, e.err)
+}
+
+func (e *gaveUpError) Unwrap() error { return e.err }
+
+func (e *gaveUpError) Is(target error) bool { return target == e.ctxErr }
+
+// temporary reports whether a request that failed with err may succeed
+// if it is sent again: the response was a 5xx or rate limited, or there
+// was no response because the connection failed or timed out. Anything
+// else, such as an invalid certificate or a malformed response, fails
+// the same way every time.
+func temporary(ctx context.Context, err error) bool {
+	// The caller gave up.
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var apiErr *Error
+	if xerrors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	// Every error from http.Client.Do is a *url.Error, which is a
+	// net.Error whatever the cause, so look at what it wraps.
+	var urlErr *url.Error
+	if xerrors.As(err, &urlErr) {
+		if urlErr.Timeout() {
+			return true
+		}
+		err = urlErr.Err
+	}
+
+	var (
+		dnsErr *net.DNSError
+		netErr net.Error
+	)
+	switch {
+	case xerrors.As(err, &dnsErr):
+		// An unknown host won't appear by asking again.
+		return !dnsErr.IsNotFound
+	case xerrors.Is(err, context.DeadlineExceeded):
+		// The attempt timed out.
+		return true
+	case xerrors.Is(err, syscall.ECONNRESET),
+		xerrors.Is(err, io.ErrUnexpectedEOF),
+		// Coder Cloud closed the connection without responding,
+		// usually a keep-alive connection it had just timed out.
+		xerrors.Is(err, io.EOF):
+		return true
+	case xerrors.As(err, &netErr):
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the delay the response that caused err asked for.
+func retryAfter(err error) time.Duration {
+	var apiErr *Error
+	if !xerrors.As(err, &apiErr) {
+		return 0
+	}
+	return apiErr.RetryAfter
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number
+// of seconds or an HTTP date.
+func parseRetryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && time.Until(t) > 0 {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cloud-agent/internal/backoff"
+)
+
+func TestTemporary(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://cloud.example.com/api/users/me", Err: err}
+	}
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "503", err: &Error{StatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "429", err: xerrors.Errorf("get: %w", &Error{StatusCode: http.StatusTooManyRequests}), want: true},
+		{name: "404", err: &Error{StatusCode: http.StatusNotFound}},
+		{name: "401", err: &Error{StatusCode: http.StatusUnauthorized}},
+		{name: "attempt timed out", err: urlErr(context.DeadlineExceeded), want: true},
+		{name: "connection reset", err: urlErr(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), want: true},
+		{name: "connection refused", err: urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), want: true},
+		{name: "closed without response", err: urlErr(io.EOF), want: true},
+		{name: "truncated body", err: xerrors.Errorf("unmarshal response: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "unknown host", err: urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "cloud.example.com", IsNotFound: true}})},
+		{name: "dns timeout", err: urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "timeout", Name: "cloud.example.com", IsTimeout: true}}), want: true},
+		{name: "untrusted certificate", err: urlErr(x509.UnknownAuthorityError{})},
+		{name: "unsupported scheme", err: urlErr(xerrors.New(`unsupported protocol scheme "ftp"`))},
+		{name: "malformed response", err: xerrors.Errorf("unmarshal response: %w", &json.SyntaxError{})},
+		{name: "canceled", ctx: canceled, err: &Error{StatusCode: http.StatusServiceUnavailable}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := tc.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if got := temporary(ctx, tc.err); got != tc.want {
+				t.Fatalf("temporary(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		h    string
+		// The delay must be within [min, max].
+		min, max time.Duration
+	}{
+		{name: "empty"},
+		{name: "seconds", h: "120", min: 2 * time.Minute, max: 2 * time.Minute},
+		{name: "zero seconds", h: "0"},
+		{name: "negative seconds", h: "-5"},
+		{name: "http date", h: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), min: 59 * time.Minute, max: time.Hour},
+		{name: "past date", h: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)},
+		{name: "garbage", h: "soon"},
+		{name: "fractional seconds", h: "1.5"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseRetryAfter(tc.h)
+			if got < tc.min || got > tc.max {
+				t.Fatalf("parseRetryAfter(%q) = %v, want between %v and %v", tc.h, got, tc.min, tc.max)
+			}
+		})
+	}
+}
+
+// unavailable starts a server answering every request with a 503 and
+// returns a client for it along with the number of requests it got.
+func unavailable(t *testing.T, retryAfter string, policy RetryPolicy) (*Client, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL)
+	return &Client{BaseURL: u, Retry: &policy}, &requests
+}
+
+func TestRetryMaxElapsed(t *testing.T) {
+	policy := RetryPolicy{
+		Policy:     backoff.Policy{Initial: 50 * time.Millisecond, Multiplier: 1},
+		MaxElapsed: 300 * time.Millisecond,
+	}
+	c, requests := unavailable(t, "", policy)
+
+	start := time.Now()
+	_, err := c.Me(context.Background())
+	elapsed := time.Since(start)
+
+	if StatusCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want the last 503", err)
+	}
+	if elapsed > policy.MaxElapsed {
+		t.Fatalf("retried for %v, past MaxElapsed", elapsed)
+	}
+	if n := atomic.LoadInt32(requests); n < 2 {
+		t.Fatalf("got %d requests, want retries until MaxElapsed", n)
+	}
+}
+
+func TestRetryAfterPastMaxElapsed(t *testing.T) {
+	// Waiting as long as Retry-After asks would exceed MaxElapsed, so
+	// the request is given up right away.
+	policy := RetryPolicy{
+		Policy:     backoff.Policy{Initial: 10 * time.Millisecond, MaxAttempts: 5},
+		MaxElapsed: time.Second,
+	}
+	c, requests := unavailable(t, "60", policy)
+
+	start := time.Now()
+	_, err := c.Me(context.Background())
+	if StatusCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want the 503", err)
+	}
+	if d := time.Since(start); d > policy.MaxElapsed {
+		t.Fatalf("waited %v", d)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("got %d requests, want 1", n)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	policy := RetryPolicy{
+		Policy: backoff.Policy{Initial: time.Minute},
+	}
+	c, requests := unavailable(t, "", policy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := c.Me(ctx)
+
+	// Both the last response and the reason for giving up are kept.
+	if StatusCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want the 503", err)
+	}
+	if !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the context's error", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("got %d requests, want 1", n)
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"time"
 )
 
@@ -13,11 +14,11 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-func (c *Client) Me() (*User, error) {
+func (c *Client) Me(ctx context.Context) (*User, error) {
 	const path = "/api/users/me"
 
 	var response User
-	err := c.requestBody("GET", path, nil, &response)
+	err := c.requestBody(ctx, "GET", path, nil, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -25,3 +26,10 @@ func (c *Client) Me() (*User, error) {
 	return &response, nil
 
 }
+
+// Logout revokes the client's session token.
+func (c *Client) Logout(ctx context.Context) error {
+	const path = "/api/users/me/session"
+
+	return c.requestBody(ctx, "DELETE", path, nil, nil)
+}
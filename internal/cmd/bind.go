@@ -4,37 +4,65 @@ import (
 	"context"
 	"net/url"
 	"os"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"cdr.dev/slog/sloggers/sloghuman"
 	"github.com/spf13/pflag"
 	"golang.org/x/xerrors"
 
 	"go.coder.com/cli"
+	"go.coder.com/cloud-agent/internal/backoff"
 	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/cloud-agent/internal/codeserver"
 	"go.coder.com/cloud-agent/internal/config"
 	"go.coder.com/cloud-agent/internal/ideproxy"
 	"go.coder.com/flog"
 )
 
 var (
-	DefaultCloudURL = "https://cloud.coder.com"
+	DefaultCloudURL = config.DefaultCloudURL
 )
 
-var codeServerNameRx = regexp.MustCompile("^[a-z0-9][a-z0-9_]{0,50}$")
+// execWait is how long bind waits for a code-server it started to come
+// up unless told otherwise.
+const execWait = 30 * time.Second
 
 type bindCmd struct {
 	cloudURL       string
 	codeServerAddr string
+	headless       bool
+	healthCheck    string
+	waitCodeServer time.Duration
+	exec           string
+
+	reconnectDelay       time.Duration
+	reconnectMaxDelay    time.Duration
+	reconnectMaxAttempts int
+	drainTimeout         time.Duration
+
+	keepaliveInterval time.Duration
+	pingInterval      time.Duration
+	pingTimeout       time.Duration
+
+	caCert             string
+	clientCert         string
+	clientKey          string
+	insecureSkipVerify bool
+
+	proxy string
+
+	// codeServer is the code-server started with --exec. mu guards it
+	// as a second signal kills it from another goroutine.
+	mu         sync.Mutex
+	codeServer *codeserver.Process
 }
 
 func (c *bindCmd) Spec() cli.CommandSpec {
 	return cli.CommandSpec{
 		Name:  "bind",
 		Usage: "[NAME]",
-		Desc:  "Bind a server to --link. A name will be generated from the hostname if one is not provided.",
+		Desc:  "Bind a server to --link. A name will be generated from the hostname if one is not provided.\nFlags that aren't set are read from the environment and the active profile in the config file.",
 	}
 }
 
@@ -42,18 +70,87 @@ func (c *bindCmd) RegisterFlags(fl *pflag.FlagSet) {
 	fl.StringVar(&c.cloudURL, "cloud-url", DefaultCloudURL, "The Coder Cloud URL to connect to.")
 	fl.StringVar(&c.codeServerAddr,
 		"code-server-addr",
-		"localhost:8080",
+		config.DefaultCodeServerAddr,
 		"The address of the code-server instance to proxy.",
 	)
+	fl.StringVar(&c.exec,
+		"exec",
+		"",
+		"A command starting code-server, e.g. \"code-server --auth none\". It is run on a free port unless it sets --bind-addr, restarted whenever it exits and stopped with bind. Overrides --code-server-addr.",
+	)
+	fl.BoolVar(&c.headless, "headless", false, "Log in with a device code instead of opening a browser.")
+	fl.StringVar(&c.healthCheck,
+		"health-check",
+		config.DefaultHealthCheck,
+		"How code-server is checked to be up: http requests its /healthz endpoint, tcp only connects to it.",
+	)
+	fl.DurationVar(&c.waitCodeServer,
+		"wait-code-server",
+		0,
+		"How long to wait for code-server to come up before binding. 0 binds right away.",
+	)
+	fl.DurationVar(&c.reconnectDelay,
+		"reconnect-delay",
+		time.Duration(config.DefaultReconnectDelay),
+		"The delay before reconnecting to Coder Cloud. It doubles after every failed attempt.",
+	)
+	fl.DurationVar(&c.reconnectMaxDelay,
+		"reconnect-max-delay",
+		time.Duration(config.DefaultReconnectMaxDelay),
+		"The maximum delay between reconnects.",
+	)
+	fl.IntVar(&c.reconnectMaxAttempts,
+		"reconnect-max-attempts",
+		0,
+		"The number of consecutive failed reconnects after which to give up. 0 retries forever.",
+	)
+	fl.DurationVar(&c.drainTimeout,
+		"drain-timeout",
+		time.Duration(config.DefaultDrainTimeout),
+		"How long active IDE connections are given to finish when shutting down on SIGINT or SIGTERM.",
+	)
+	fl.DurationVar(&c.keepaliveInterval,
+		"keepalive-interval",
+		time.Duration(config.DefaultKeepaliveInterval),
+		"How often the tunnel to Coder Cloud is checked for liveness.",
+	)
+	fl.DurationVar(&c.pingInterval,
+		"ping-interval",
+		time.Duration(config.DefaultPingInterval),
+		"How often the websocket to Coder Cloud is pinged.",
+	)
+	fl.DurationVar(&c.pingTimeout,
+		"ping-timeout",
+		time.Duration(config.DefaultPingTimeout),
+		"How long to wait for a websocket pong before reconnecting.",
+	)
+	fl.StringVar(&c.caCert, "ca-cert", "", "A PEM bundle of certificate authorities to trust in addition to the system's.")
+	fl.StringVar(&c.clientCert, "client-cert", "", "A PEM client certificate to present to Coder Cloud. Requires --client-key.")
+	fl.StringVar(&c.clientKey, "client-key", "", "The PEM private key of --client-cert.")
+	fl.BoolVar(&c.insecureSkipVerify, "insecure-skip-verify", false, "Don't verify Coder Cloud's TLS certificate. This is insecure and only meant for debugging.")
+	fl.StringVar(&c.proxy, "proxy", "", proxyUsage)
 }
 
 func (c *bindCmd) Run(fl *pflag.FlagSet) {
-	var (
-		err error
-		ctx = context.Background()
-	)
+	ctx, stop := shutdownContext(c.killCodeServer)
+	defer stop()
+
+	var err error
+
+	cfg, profile := loadProfile()
+	// Defaults are applied once flags are, so they can't conflict with
+	// the flags.
+	settings, err := cfg.Profile(profile).WithEnv()
+	if err != nil {
+		flog.Fatal("Invalid settings: %v", err)
+	}
 
 	name := fl.Arg(0)
+	if name == "" {
+		name = settings.ServerName
+	}
+	// A server bound before keeps its name unless a new one is given.
+	explicit := name != ""
 	if name == "" {
 		// Generate a name based on the hostname if one is not provided.
 		name, err = genServerName()
@@ -62,87 +159,332 @@ func (c *bindCmd) Run(fl *pflag.FlagSet) {
 		}
 	}
 
-	if !codeServerNameRx.MatchString(name) {
-		flog.Fatal("Name must conform to regex %s", codeServerNameRx.String())
+	if !config.ServerNameRx.MatchString(name) {
+		flog.Fatal("Name must conform to regex %s", config.ServerNameRx.String())
 	}
 
-	cloudURL, err := url.Parse(c.cloudURL)
+	unlock, err := config.LockServer(profile, name)
+	if xerrors.Is(err, config.ErrLocked) {
+		flog.Fatal("Another agent on this machine is already bound with this profile, which serves one server at a time. Use --profile to bind %q at the same time: %v", name, err)
+	}
 	if err != nil {
-		flog.Fatal("Invalid Cloud URL: %v", err.Error())
+		flog.Fatal("Failed to lock server: %v", err)
 	}
+	defer unlock()
 
-	token, err := config.SessionToken.Read()
-	if xerrors.Is(err, os.ErrNotExist) {
-		checkLatency(c.cloudURL)
-		token, err = login(cloudURL.String(), name)
-	}
+	rawURL, err := resolveCloudURL(fl, c.cloudURL, cfg, profile)
 	if err != nil {
-		flog.Fatal("Failed to login: %v", err)
+		flog.Fatal("%v", err)
 	}
 
-	cli := client.Client{
-		Token:   token,
-		BaseURL: cloudURL,
+	cloudURL, err := url.Parse(rawURL)
+	if err != nil {
+		flog.Fatal("Invalid Cloud URL: %v", err.Error())
 	}
 
-	// Register the server with Coder Cloud. This is an idempotent
-	// operation.
-	cs, err := cli.RegisterCodeServer(name)
+	if fl.Changed("code-server-addr") {
+		settings.CodeServerAddr = c.codeServerAddr
+	}
+	if fl.Changed("headless") {
+		settings.Headless = c.headless
+	}
+	if fl.Changed("exec") {
+		settings.Exec = c.exec
+	}
+	if fl.Changed("health-check") {
+		settings.Health.Check = c.healthCheck
+	}
+	if fl.Changed("wait-code-server") {
+		settings.Health.Wait = config.Duration(c.waitCodeServer)
+	}
+	if fl.Changed("reconnect-delay") {
+		settings.Reconnect.Delay = config.Duration(c.reconnectDelay)
+	}
+	if fl.Changed("reconnect-max-delay") {
+		settings.Reconnect.MaxDelay = config.Duration(c.reconnectMaxDelay)
+	}
+	if fl.Changed("reconnect-max-attempts") {
+		settings.Reconnect.MaxAttempts = c.reconnectMaxAttempts
+	}
+	if fl.Changed("drain-timeout") {
+		settings.DrainTimeout = config.Duration(c.drainTimeout)
+	}
+	if fl.Changed("keepalive-interval") {
+		settings.Keepalive.Interval = config.Duration(c.keepaliveInterval)
+	}
+	if fl.Changed("ping-interval") {
+		settings.Keepalive.PingInterval = config.Duration(c.pingInterval)
+	}
+	if fl.Changed("ping-timeout") {
+		settings.Keepalive.PingTimeout = config.Duration(c.pingTimeout)
+	}
+	if fl.Changed("ca-cert") {
+		settings.TLS.CACert = c.caCert
+	}
+	if fl.Changed("client-cert") {
+		settings.TLS.ClientCert = c.clientCert
+	}
+	if fl.Changed("client-key") {
+		settings.TLS.ClientKey = c.clientKey
+	}
+	if fl.Changed("insecure-skip-verify") {
+		settings.TLS.InsecureSkipVerify = c.insecureSkipVerify
+	}
+	if fl.Changed("proxy") {
+		settings.Proxy = c.proxy
+	}
+	err = settings.Validate()
 	if err != nil {
-		flog.Fatal("Failed to register server: %v", err)
+		flog.Fatal("Invalid flags: %v", err)
 	}
+	settings = settings.WithDefaults()
 
-	// Get the Access URL for the user.
-	url, err := cli.AccessURL(cs.ID)
+	password, err := settings.Password.Read()
 	if err != nil {
-		flog.Fatal("Failed to query server: %v", err)
+		flog.Fatal("Failed to read code-server password: %v", err)
 	}
 
-	agent := &ideproxy.Agent{
-		Log:            sloghuman.Make(os.Stderr),
-		CodeServerID:   cs.ID,
-		SessionToken:   token,
-		CloudProxyURL:  c.cloudURL,
-		CodeServerAddr: c.codeServerAddr,
+	log, err := makeLogger(settings.Log)
+	if err != nil {
+		flog.Fatal("Failed to open log: %v", err)
 	}
 
-	proxy := func() {
-		err = agent.Proxy(ctx)
+	// Anything that exits on failure must be set up before code-server
+	// is started, or it would be left running.
+	hc := mustHTTPClient(settings)
+
+	if settings.Exec != "" {
+		args, addr, err := codeserver.Command(settings.Exec)
+		if err != nil {
+			flog.Fatal("Invalid exec command: %v", err)
+		}
+		settings.CodeServerAddr = addr
+		if settings.Health.Wait == 0 {
+			settings.Health.Wait = config.Duration(execWait)
+		}
+
+		cs := codeserver.New(log.Named("code-server"), args)
+		err = cs.Start()
 		if err != nil {
-			flog.Error("Connection disrupted, re-establishing connection: %v", err.Error())
+			flog.Fatal("Failed to start code-server: %v", err)
 		}
+		c.mu.Lock()
+		c.codeServer = cs
+		c.mu.Unlock()
+		flog.Info("Started code-server on %s", addr)
+	}
+
+	upstream := &ideproxy.Upstream{
+		Log:      log,
+		Addr:     settings.CodeServerAddr,
+		Check:    settings.Health.Check,
+		Interval: time.Duration(settings.Health.Interval),
+		Timeout:  time.Duration(settings.Health.Timeout),
+	}
+	err = waitCodeServer(ctx, upstream, time.Duration(settings.Health.Wait))
+	if ctx.Err() != nil {
+		c.shutDown()
+		return
+	}
+	if err != nil {
+		c.fatal("%v", err)
+	}
+
+	sess, err := authenticate(ctx, cfg, profile, cloudURL, hc, name, settings.Headless)
+	if canceled(ctx, err) {
+		c.shutDown()
+		return
 	}
+	if err != nil {
+		c.fatal("Failed to login: %v", err)
+	}
+
+	cs, err := bindServer(ctx, sess, name, explicit)
+	if canceled(ctx, err) {
+		c.shutDown()
+		return
+	}
+	if err != nil {
+		c.fatal("Failed to register server: %v", err)
+	}
+	name = cs.Name
+
+	// Get the Access URL for the user.
+	var url string
+	err = sess.withReauth(ctx, func() error {
+		url, err = sess.client.AccessURL(ctx, cs.ID)
+		return err
+	})
+	if canceled(ctx, err) {
+		c.shutDown()
+		return
+	}
+	if err != nil {
+		c.fatal("Failed to query server: %v", err)
+	}
+
+	agent := &ideproxy.Agent{
+		Log:                log,
+		CodeServerID:       cs.ID,
+		SessionToken:       sess.client.Token,
+		CloudProxyURL:      cloudURL.String(),
+		CodeServerAddr:     settings.CodeServerAddr,
+		CodeServerPassword: password,
+		HTTPClient:         hc,
+		DrainTimeout:       time.Duration(settings.DrainTimeout),
+		Keepalive: ideproxy.Keepalive{
+			Interval:     time.Duration(settings.Keepalive.Interval),
+			WriteTimeout: time.Duration(settings.Keepalive.WriteTimeout),
+			WindowSize:   uint32(settings.Keepalive.WindowSize),
+			PingInterval: time.Duration(settings.Keepalive.PingInterval),
+			PingTimeout:  time.Duration(settings.Keepalive.PingTimeout),
+		},
+	}
+	go upstream.Run(ctx)
 
 	flog.Info("code-server --link is deprecated. While the servers will remain online,")
 	flog.Info("we are not releasing new features or bugfixes. A future code-server")
 	flog.Info("release will include a v2 with new features. If you would")
 	flog.Info("like early access, reach out on https://cdr.co/join-community")
 	flog.Info("")
-	
 
 	flog.Info("Proxying code-server, you can access your IDE at %v", url)
 
-	proxy()
+	reconnect := backoff.New(backoff.Policy{
+		Initial:     time.Duration(settings.Reconnect.Delay),
+		Max:         time.Duration(settings.Reconnect.MaxDelay),
+		Multiplier:  *settings.Reconnect.Multiplier,
+		Jitter:      *settings.Reconnect.Jitter,
+		MaxAttempts: settings.Reconnect.MaxAttempts,
+	})
+	// reloggedIn is set if the last connection was rejected and the
+	// user logged in again, so a token rejected again isn't replaced by
+	// prompting in a loop.
+	var reloggedIn bool
+	for {
+		start := time.Now()
+		err = agent.Proxy(ctx)
+		if ctx.Err() != nil {
+			if xerrors.Is(err, ideproxy.ErrDrainTimeout) {
+				c.fatal("Closed active connections after waiting %s for them to finish", time.Duration(settings.DrainTimeout))
+			}
+			// The connection may have been interrupted while being
+			// established.
+			if !canceled(ctx, err) {
+				c.fatal("Failed to shut down cleanly: %v", err)
+			}
+			c.shutDown()
+			return
+		}
+		if client.IsUnauthorized(err) {
+			if reloggedIn {
+				c.fatal("Coder Cloud rejected the session right after logging in again: %v", err)
+			}
+			err = sess.relogin(ctx)
+			if err == nil {
+				agent.SessionToken = sess.client.Token
+				reloggedIn = true
+				continue
+			}
+			err = xerrors.Errorf("login: %w", err)
+		}
+		reloggedIn = false
+		if client.IsNotFound(err) {
+			c.fatal("Server %q no longer exists, run bind again to register it: %v", name, err)
+		}
+		if err != nil && !ideproxy.Retryable(err) {
+			c.fatal("Connection failed permanently: %v", err)
+		}
+
+		// A connection that stayed up for a while means the cloud is
+		// healthy, so start over with a short delay.
+		if time.Since(start) >= time.Duration(settings.Reconnect.ResetAfter) {
+			reconnect.Reset()
+		}
+
+		delay, ok := reconnect.Next()
+		if !ok {
+			c.fatal("Giving up after %d failed reconnects: %v", reconnect.Attempt(), err)
+		}
 
-	// Avoid a super tight loop.
-	ticker := time.NewTicker(time.Second)
-	for range ticker.C {
-		proxy()
+		if err != nil {
+			flog.Error("Connection disrupted, re-establishing connection in %s: %v", delay.Round(time.Millisecond), err.Error())
+		} else {
+			flog.Info("Connection closed, re-establishing connection in %s", delay.Round(time.Millisecond))
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			c.shutDown()
+			return
+		case <-t.C:
+		}
 	}
 }
 
-func login(url, serverName string) (string, error) {
-	token, err := client.Login(url, serverName)
-	if err != nil {
-		return "", xerrors.Errorf("unable to login: %w", err)
+// waitCodeServer waits for code-server to come up, returning an error if
+// it doesn't within wait. If wait is zero, code-server is only checked
+// once and a warning printed if it's down.
+func waitCodeServer(ctx context.Context, upstream *ideproxy.Upstream, wait time.Duration) error {
+	if wait == 0 {
+		err := upstream.Probe(ctx)
+		if err != nil && ctx.Err() == nil {
+			flog.Error("code-server isn't reachable at %s, the IDE won't load until it is: %v", upstream.Addr, err)
+		}
+		return nil
 	}
 
-	err = config.SessionToken.Write(token)
+	flog.Info("Waiting up to %s for code-server at %s", wait, upstream.Addr)
+	wctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	err := upstream.Wait(wctx)
 	if err != nil {
-		return "", xerrors.Errorf("write session token to file: %w", err)
+		return xerrors.Errorf("code-server didn't come up at %s within %s: %w", upstream.Addr, wait, err)
+	}
+	return nil
+}
+
+// canceled reports whether err is only the result of ctx being canceled
+// because bind was asked to shut down.
+func canceled(ctx context.Context, err error) bool {
+	return ctx.Err() != nil && (err == nil || xerrors.Is(err, context.Canceled))
+}
+
+// shutDown stops code-server if bind started it and reports a clean
+// shutdown.
+func (c *bindCmd) shutDown() {
+	c.stopCodeServer()
+	flog.Success("Shut down")
+}
+
+// fatal stops code-server if bind started it and exits with the
+// message.
+func (c *bindCmd) fatal(format string, args ...interface{}) {
+	c.stopCodeServer()
+	flog.Fatal(format, args...)
+}
+
+// stopCodeServer stops code-server if bind started it.
+func (c *bindCmd) stopCodeServer() {
+	c.mu.Lock()
+	cs := c.codeServer
+	c.mu.Unlock()
+	if cs != nil {
+		cs.Stop()
 	}
+}
 
-	return token, nil
+// killCodeServer kills code-server if bind started it, without waiting
+// for it to exit. Its process group doesn't get the terminal's signals,
+// so it would outlive bind otherwise.
+func (c *bindCmd) killCodeServer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.codeServer != nil {
+		c.codeServer.Kill()
+	}
 }
 
 func genServerName() (string, error) {
@@ -159,15 +501,78 @@ func genServerName() (string, error) {
 	return strings.Replace(hostname, "-", "_", -1), nil
 }
 
-func checkLatency(cloudURL string) {
-	latency, tolerable, err := client.Ping(cloudURL)
+// bindServer returns the server this machine serves, renaming it if a
+// new name was given. The server registered by a previous bind is
+// reused so it keeps its ID and access URL, otherwise a server is
+// registered and its ID stored in the profile.
+func bindServer(ctx context.Context, sess *session, name string, explicit bool) (*client.CodeServer, error) {
+	var (
+		cs  *client.CodeServer
+		err error
+		id  = sess.cfg.Profile(sess.profile).ServerID
+	)
+	if id != "" {
+		err = sess.withReauth(ctx, func() error {
+			cs, err = sess.client.CodeServer(ctx, id)
+			return err
+		})
+		if client.IsNotFound(err) {
+			flog.Info("Server %s bound previously no longer exists, registering a new one", id)
+			cs, err = nil, nil
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("get server %s: %w", id, err)
+		}
+	}
+
+	if cs != nil {
+		if !explicit || cs.Name == name {
+			return cs, nil
+		}
+
+		old := cs.Name
+		err = sess.withReauth(ctx, func() error {
+			cs, err = sess.client.RenameCodeServer(ctx, id, name)
+			return err
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("rename server %q to %q: %w", old, name, err)
+		}
+		flog.Info("Renamed server %q to %q", old, name)
+		return cs, nil
+	}
+
+	// Registering is an idempotent operation.
+	err = sess.withReauth(ctx, func() error {
+		cs, err = sess.client.RegisterCodeServer(ctx, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fresh, err := config.Update(func(c *config.Config) error {
+		c.Profile(sess.profile).ServerID = cs.ID
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("store server ID: %w", err)
+	}
+	*sess.cfg = *fresh
+
+	return cs, nil
+}
+
+func checkLatency(ctx context.Context, cli *client.Client) error {
+	latency, tolerable, err := cli.Ping(ctx)
 	if err != nil {
-		flog.Fatal("ping server: %s", err.Error())
+		return xerrors.Errorf("ping server: %w", err)
 	}
 
 	if !tolerable {
-		flog.Fatal("Unfortunately we cannot ensure a good user experience with your connection latency (%s). Efforts are underway to accommodate users in most areas.", latency)
+		return xerrors.Errorf("unfortunately we cannot ensure a good user experience with your connection latency (%s). Efforts are underway to accommodate users in most areas", latency)
 	}
 
 	flog.Info("Detected an acceptable latency of %s", latency)
+	return nil
 }
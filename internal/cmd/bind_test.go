@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/cloud-agent/internal/config"
+	"go.coder.com/cloud-agent/pkg/cloudtest"
+)
+
+// testSession returns a session logged in to the fake cloud with
+// cloudtest.Session, using a config stored in a temporary directory.
+func testSession(t *testing.T, cloud *cloudtest.Server) *session {
+	t.Setenv(config.ConfigDirEnv, t.TempDir())
+	t.Setenv(config.SessionTokenEnv, "")
+
+	cfg, err := config.Update(func(c *config.Config) error {
+		c.Profile(config.DefaultProfile).CloudURL = cloud.URL
+		return c.SetSessionToken(config.DefaultProfile, cloudtest.Session)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &session{
+		client:  &client.Client{Token: cloudtest.Session, BaseURL: cloud.BaseURL()},
+		cfg:     cfg,
+		profile: config.DefaultProfile,
+	}
+}
+
+func TestBindServer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// stored is the name of the server bound previously, if any.
+		stored string
+		// deleted deletes the stored server from the cloud.
+		deleted  bool
+		bind     string
+		explicit bool
+		// wantName is the name of the bound server, and wantReused
+		// whether it is the stored one.
+		wantName   string
+		wantReused bool
+	}{
+		{name: "first bind", bind: "laptop", explicit: true, wantName: "laptop"},
+		{name: "stored server", stored: "laptop", bind: "generated", wantName: "laptop", wantReused: true},
+		{name: "same name", stored: "laptop", bind: "laptop", explicit: true, wantName: "laptop", wantReused: true},
+		{name: "renamed", stored: "laptop", bind: "desktop", explicit: true, wantName: "desktop", wantReused: true},
+		{name: "stored server deleted", stored: "laptop", deleted: true, bind: "desktop", explicit: true, wantName: "desktop"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cloud := cloudtest.New()
+			defer cloud.Close()
+			sess := testSession(t, cloud)
+			ctx := context.Background()
+
+			var storedID string
+			if tc.stored != "" {
+				storedID = cloud.AddCodeServer(cloudtest.CodeServer{Name: tc.stored}).ID
+				if tc.deleted {
+					err := sess.client.DeleteCodeServer(ctx, storedID)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				_, err := config.Update(func(c *config.Config) error {
+					c.Profile(config.DefaultProfile).ServerID = storedID
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				sess.cfg.Profile(config.DefaultProfile).ServerID = storedID
+			}
+
+			cs, err := bindServer(ctx, sess, tc.bind, tc.explicit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cs.Name != tc.wantName {
+				t.Fatalf("bound server %q, want %q", cs.Name, tc.wantName)
+			}
+			if reused := cs.ID == storedID; reused != tc.wantReused {
+				t.Fatalf("reused the stored server: %v, want %v", reused, tc.wantReused)
+			}
+
+			// The cloud holds only the bound server, under its new name.
+			servers := cloud.CodeServers()
+			if len(servers) != 1 || servers[0].ID != cs.ID || servers[0].Name != tc.wantName {
+				t.Fatalf("cloud has servers %+v", servers)
+			}
+
+			// The next bind finds the server again.
+			cfg, err := config.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id := cfg.Profile(config.DefaultProfile).ServerID; id != cs.ID {
+				t.Fatalf("stored server ID %q, want %q", id, cs.ID)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package cmd
 import (
 	"github.com/spf13/pflag"
 	"go.coder.com/cli"
+
+	"go.coder.com/cloud-agent/internal/config"
 )
 
 func Make() cli.Command {
@@ -12,6 +14,7 @@ func Make() cli.Command {
 var _ interface {
 	cli.Command
 	cli.ParentCommand
+	cli.FlaggedCommand
 } = &rootCmd{}
 
 type rootCmd struct {
@@ -21,17 +24,31 @@ func (c *rootCmd) Spec() cli.CommandSpec {
 	return cli.CommandSpec{
 		Name:  "agent",
 		Usage: "[GLOBAL FLAGS] COMMAND [COMMAND FLAGS] [ARGS...]",
-		Desc:  `Run the Coder Cloud Agent.`,
+		Desc: `Run the Coder Cloud Agent.
+
+Settings are resolved from command flags, then CODER_CLOUD_* environment
+variables, then the active profile in the config file, then defaults.
+Set CODER_CLOUD_CONFIG_DIR to change where the config file is stored.`,
 	}
 }
 
 func (c *rootCmd) Subcommands() []cli.Command {
 	return []cli.Command{
 		&bindCmd{},
+		&loginCmd{},
+		&logoutCmd{},
+		&whoamiCmd{},
+		&serversCmd{},
+		&profileCmd{},
+		&configCmd{},
 		&versionCmd{},
 	}
 }
 
+func (c *rootCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVar(&profileFlag, "profile", "", "The profile to use. Overrides $"+config.ProfileEnv+" and the profile selected with profile use.")
+}
+
 func (c *rootCmd) Run(fl *pflag.FlagSet) {
 	fl.Usage()
 }
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+
+	"go.coder.com/cli"
+	"go.coder.com/cloud-agent/internal/config"
+	"go.coder.com/flog"
+)
+
+type configCmd struct{}
+
+func (c *configCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "config",
+		Usage: "COMMAND",
+		Desc:  "Inspect and edit the agent's settings for the active profile.",
+	}
+}
+
+func (c *configCmd) Subcommands() []cli.Command {
+	return []cli.Command{
+		&configPathCmd{},
+		&configGetCmd{},
+		&configSetCmd{},
+		&configUnsetCmd{},
+		&configListCmd{},
+	}
+}
+
+func (c *configCmd) Run(fl *pflag.FlagSet) {
+	fl.Usage()
+}
+
+type configPathCmd struct{}
+
+func (c *configPathCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "path",
+		Usage: "",
+		Desc:  "Print the path of the config file.",
+	}
+}
+
+func (c *configPathCmd) Run(fl *pflag.FlagSet) {
+	path, err := config.Path()
+	if err != nil {
+		flog.Fatal("Failed to resolve config path: %v", err)
+	}
+	fmt.Println(path)
+}
+
+type configGetCmd struct {
+	reveal bool
+}
+
+func (c *configGetCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "get",
+		Usage: "KEY",
+		Desc:  "Print a setting stored in the config file.\nKeys: " + strings.Join(config.Keys(), ", "),
+	}
+}
+
+func (c *configGetCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.BoolVar(&c.reveal, "reveal", false, "Print secret values instead of redacting them.")
+}
+
+func (c *configGetCmd) Run(fl *pflag.FlagSet) {
+	key := fl.Arg(0)
+	if key == "" {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	cfg, profile := loadProfile()
+
+	val, err := cfg.Get(profile, key)
+	if err != nil {
+		flog.Fatal("Failed to get %s: %v", key, err)
+	}
+	if config.IsSecret(key) && val != "" && !c.reveal {
+		val = config.Redacted
+	}
+
+	fmt.Println(val)
+}
+
+type configSetCmd struct{}
+
+func (c *configSetCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "set",
+		Usage: "KEY VALUE",
+		Desc:  "Store a setting in the config file.\nKeys: " + strings.Join(config.Keys(), ", "),
+	}
+}
+
+func (c *configSetCmd) Run(fl *pflag.FlagSet) {
+	if fl.NArg() != 2 {
+		fl.Usage()
+		os.Exit(2)
+	}
+	key, val := fl.Arg(0), fl.Arg(1)
+
+	_, profile := loadProfile()
+
+	_, err := config.Update(func(c *config.Config) error {
+		return c.Set(profile, key, val)
+	})
+	if err != nil {
+		flog.Fatal("Failed to set %s: %v", key, err)
+	}
+}
+
+type configUnsetCmd struct{}
+
+func (c *configUnsetCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "unset",
+		Usage: "KEY",
+		Desc:  "Remove a setting from the config file so its default applies.",
+	}
+}
+
+func (c *configUnsetCmd) Run(fl *pflag.FlagSet) {
+	key := fl.Arg(0)
+	if key == "" {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	_, profile := loadProfile()
+
+	_, err := config.Update(func(c *config.Config) error {
+		return c.Unset(profile, key)
+	})
+	if err != nil {
+		flog.Fatal("Failed to unset %s: %v", key, err)
+	}
+}
+
+type configListCmd struct{}
+
+func (c *configListCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "list",
+		Usage: "",
+		Desc:  "List the effective settings and where they come from. Secrets are redacted.",
+	}
+}
+
+func (c *configListCmd) Run(fl *pflag.FlagSet) {
+	cfg, profile := loadProfile()
+
+	entries, err := cfg.List(profile)
+	if err != nil {
+		flog.Fatal("Failed to list settings: %v", err)
+	}
+
+	path, err := config.Path()
+	if err != nil {
+		flog.Fatal("Failed to resolve config path: %v", err)
+	}
+
+	fmt.Printf("# config: %s\n", path)
+	fmt.Printf("# profile: %s\n", profile)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, e := range entries {
+		source := ""
+		if e.Source != "" {
+			source = "(" + e.Source + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Key, e.Value, source)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,400 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"go.coder.com/cloud-agent/internal/backoff"
+	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/cloud-agent/internal/config"
+	"go.coder.com/cloud-agent/pkg/cloudtest"
+)
+
+// TestProxyTunnel checks the tunnel websocket to Coder Cloud is dialed
+// through HTTP and SOCKS5 proxies with credentials.
+func TestProxyTunnel(t *testing.T) {
+	for _, env := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"} {
+		t.Setenv(env, "")
+	}
+
+	cloud := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/proxy/ide/abc/server" || r.Header.Get("Session-Token") != "token" {
+			http.NotFound(w, r)
+			return
+		}
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		_ = conn.Write(r.Context(), websocket.MessageText, []byte("hello"))
+	}))
+	defer cloud.Close()
+
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cloud.Certificate().Raw,
+	}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, serve := range map[string]func(net.Conn) (string, error){
+		"http":   serveConnect,
+		"socks5": serveSOCKS5,
+	} {
+		serve := serve
+		t.Run(name, func(t *testing.T) {
+			targets := make(chan string, 1)
+			proxyAddr := listenProxy(t, cloud.Listener.Addr().String(), serve, targets)
+
+			hc, err := newHTTPClient(config.Settings{
+				TLS:   config.TLSSettings{CACert: caCert},
+				Proxy: name + "://user:pass@" + proxyAddr,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// example.com is in the test server's certificate and only
+			// reaches it through the proxy.
+			u, _ := url.Parse("https://example.com")
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			ws, err := newClient(u, "token", hc).ProxyAgent(ctx, "abc")
+			if err != nil {
+				t.Fatalf("dial tunnel: %v", err)
+			}
+			defer ws.Close(websocket.StatusNormalClosure, "")
+
+			_, msg, err := ws.Read(ctx)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(msg) != "hello" {
+				t.Fatalf("got message %q", msg)
+			}
+
+			if target := <-targets; target != "example.com:443" {
+				t.Fatalf("proxy got target %q", target)
+			}
+		})
+	}
+}
+
+// listenProxy starts a proxy that authenticates clients with serve and
+// connects every tunnel to upstream, sending the requested targets on
+// targets.
+func listenProxy(t *testing.T, upstream string, serve func(net.Conn) (string, error), targets chan<- string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				target, err := serve(conn)
+				if err != nil {
+					t.Errorf("proxy: %v", err)
+					return
+				}
+				select {
+				case targets <- target:
+				default:
+				}
+
+				up, err := net.Dial("tcp", upstream)
+				if err != nil {
+					return
+				}
+				defer up.Close()
+
+				go func() {
+					_, _ = io.Copy(up, conn)
+					up.Close()
+				}()
+				_, _ = io.Copy(conn, up)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// serveConnect handles an HTTP CONNECT handshake.
+func serveConnect(conn net.Conn) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+
+	user, pass, ok := (&http.Request{Header: http.Header{
+		"Authorization": req.Header["Proxy-Authorization"],
+	}}).BasicAuth()
+	if req.Method != http.MethodConnect || !ok || user != "user" || pass != "pass" {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", io.ErrUnexpectedEOF
+	}
+
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, err
+}
+
+// serveSOCKS5 handles a SOCKS5 handshake with username and password
+// authentication.
+func serveSOCKS5(conn net.Conn) (string, error) {
+	read := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(conn, b)
+		return b, err
+	}
+
+	hdr, err := read(2)
+	if err != nil {
+		return "", err
+	}
+	if _, err = read(int(hdr[1])); err != nil {
+		return "", err
+	}
+	if _, err = conn.Write([]byte{5, 2}); err != nil {
+		return "", err
+	}
+
+	// Username and password subnegotiation.
+	auth, err := read(2)
+	if err != nil {
+		return "", err
+	}
+	user, err := read(int(auth[1]))
+	if err != nil {
+		return "", err
+	}
+	plen, err := read(1)
+	if err != nil {
+		return "", err
+	}
+	pass, err := read(int(plen[0]))
+	if err != nil {
+		return "", err
+	}
+	if string(user) != "user" || string(pass) != "pass" {
+		_, _ = conn.Write([]byte{1, 1})
+		return "", io.ErrUnexpectedEOF
+	}
+	if _, err = conn.Write([]byte{1, 0}); err != nil {
+		return "", err
+	}
+
+	req, err := read(4)
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip, err := read(4)
+		if err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		n, err := read(1)
+		if err != nil {
+			return "", err
+		}
+		name, err := read(int(n[0]))
+		if err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", io.ErrUnexpectedEOF
+	}
+	port, err := read(2)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), err
+}
+
+// TestTLS checks the TLS settings against a Coder Cloud with a self-signed
+// certificate that may require a client certificate.
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := newCA(t)
+	clientCert, clientKey := writeClientCert(t, dir, caCert, caKey)
+
+	// A key that doesn't match the client certificate.
+	_, otherKey := writeClientCert(t, filepath.Join(dir, "other"), caCert, caKey)
+	// A file that holds no PEM blocks.
+	garbage := filepath.Join(dir, "garbage.pem")
+	err := os.WriteFile(garbage, []byte("not a certificate"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.pem")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	for _, tc := range []struct {
+		name string
+		// mutual requires a client certificate.
+		mutual bool
+		// trust adds the cloud's certificate to CACert.
+		trust bool
+		tls   config.TLSSettings
+		// wantConfigErr is the error configuring the client and
+		// wantErr the error of a request.
+		wantConfigErr string
+		wantErr       string
+	}{
+		{name: "self-signed", wantErr: "certificate signed by unknown authority"},
+		{name: "trusted", trust: true},
+		{name: "insecure skip verify", tls: config.TLSSettings{InsecureSkipVerify: true}},
+		{name: "client certificate", mutual: true, trust: true, tls: config.TLSSettings{ClientCert: clientCert, ClientKey: clientKey}},
+		{name: "no client certificate", mutual: true, trust: true, wantErr: "certificate required"},
+		{name: "missing CA bundle", tls: config.TLSSettings{CACert: missing}, wantConfigErr: "tls: read CA bundle: open " + missing},
+		{name: "bad CA bundle", tls: config.TLSSettings{CACert: garbage}, wantConfigErr: "tls: no certificates found in " + garbage},
+		{name: "missing client certificate", tls: config.TLSSettings{ClientCert: missing, ClientKey: clientKey}, wantConfigErr: "tls: load client certificate: open " + missing},
+		{name: "bad client key", tls: config.TLSSettings{ClientCert: clientCert, ClientKey: garbage}, wantConfigErr: "tls: load client certificate:"},
+		{name: "mismatched client key", tls: config.TLSSettings{ClientCert: clientCert, ClientKey: otherKey}, wantConfigErr: "private key does not match public key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cloud *cloudtest.Server
+			if tc.mutual {
+				cloud = cloudtest.NewMutualTLS(pool)
+			} else {
+				cloud = cloudtest.NewTLS()
+			}
+			defer cloud.Close()
+
+			settings := config.Settings{TLS: tc.tls}
+			if tc.trust {
+				settings.TLS.CACert = filepath.Join(t.TempDir(), "ca.pem")
+				writePEM(t, settings.TLS.CACert, "CERTIFICATE", cloud.Certificate().Raw)
+			}
+
+			hc, err := newHTTPClient(settings)
+			if tc.wantConfigErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantConfigErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantConfigErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := newClient(cloud.BaseURL(), cloudtest.Session, hc)
+			c.Retry = &client.RetryPolicy{Policy: backoff.Policy{MaxAttempts: 1}}
+			_, err = c.Me(context.Background())
+			if tc.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// newCA returns a self-signed CA certificate and its key.
+func newCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cloudtest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeClientCert writes a client certificate signed by the CA and its
+// key to dir, returning their paths.
+func writeClientCert(t *testing.T, dir string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+	return certPath, keyPath
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
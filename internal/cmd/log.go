@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"cdr.dev/slog"
+	"cdr.dev/slog/sloggers/sloghuman"
+	"cdr.dev/slog/sloggers/slogjson"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cloud-agent/internal/config"
+)
+
+// makeLogger returns the structured logger described by the settings.
+// Settings must already have defaults applied.
+func makeLogger(s config.LogSettings) (slog.Logger, error) {
+	var w io.Writer = os.Stderr
+	if s.File != "" {
+		fi, err := os.OpenFile(s.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return slog.Logger{}, xerrors.Errorf("open log file: %w", err)
+		}
+		w = fi
+	}
+
+	var log slog.Logger
+	switch s.Format {
+	case "json":
+		log = slogjson.Make(w)
+	default:
+		log = sloghuman.Make(w)
+	}
+
+	switch s.Level {
+	case "debug":
+		log = log.Leveled(slog.LevelDebug)
+	case "warn":
+		log = log.Leveled(slog.LevelWarn)
+	case "error":
+		log = log.Leveled(slog.LevelError)
+	}
+
+	return log, nil
+}
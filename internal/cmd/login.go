@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/spf13/pflag"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+)
+
+type loginCmd struct {
+	cloudURL string
+	device   bool
+	proxy    string
+}
+
+func (c *loginCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "login",
+		Usage: "",
+		Desc:  "Log in to Coder Cloud and store the session token.",
+	}
+}
+
+func (c *loginCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVar(&c.cloudURL, "cloud-url", DefaultCloudURL, "The Coder Cloud URL to connect to.")
+	fl.BoolVar(&c.device, "device", false, "Log in with a device code instead of opening a browser.")
+	fl.StringVar(&c.proxy, "proxy", "", proxyUsage)
+}
+
+func (c *loginCmd) Run(fl *pflag.FlagSet) {
+	cfg, profile := loadProfile()
+
+	rawURL, err := resolveCloudURL(fl, c.cloudURL, cfg, profile)
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+
+	cloudURL, err := url.Parse(rawURL)
+	if err != nil {
+		flog.Fatal("Invalid Cloud URL: %v", err.Error())
+	}
+
+	settings, err := cfg.Effective(profile)
+	if err != nil {
+		flog.Fatal("Invalid settings: %v", err)
+	}
+
+	// The server name is only used to redirect the user once they have
+	// logged in.
+	name := settings.ServerName
+	if name == "" {
+		name, err = genServerName()
+		if err != nil {
+			flog.Fatal("Failed to generate server name: %v", err.Error())
+		}
+	}
+
+	if fl.Changed("proxy") {
+		settings.Proxy = c.proxy
+		err = settings.Validate()
+		if err != nil {
+			flog.Fatal("Invalid settings: %v", err)
+		}
+	}
+
+	device := c.device
+	if !fl.Changed("device") {
+		device = settings.Headless
+	}
+
+	// Pass the current token as stale so a new one is always
+	// requested.
+	current, err := cfg.SessionToken(profile)
+	if err != nil {
+		flog.Fatal("Failed to read session token: %v", err)
+	}
+
+	cli := newClient(cloudURL, "", mustHTTPClient(settings))
+	_, err = login(context.Background(), cfg, profile, cli, name, device, current)
+	if err != nil {
+		flog.Fatal("Failed to login: %v", err)
+	}
+
+	flog.Success("Logged in to %s (profile %q)", cloudURL, profile)
+}
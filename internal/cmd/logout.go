@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	"go.coder.com/cli"
+	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/cloud-agent/internal/config"
+	"go.coder.com/flog"
+)
+
+type logoutCmd struct {
+	cloudURL string
+}
+
+func (c *logoutCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "logout",
+		Usage: "",
+		Desc:  "Revoke the session token and remove it from this machine.",
+	}
+}
+
+func (c *logoutCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVar(&c.cloudURL, "cloud-url", DefaultCloudURL, "The Coder Cloud URL to connect to.")
+}
+
+func (c *logoutCmd) Run(fl *pflag.FlagSet) {
+	// The token in the environment would be revoked while the stored one
+	// is deleted, logging out neither.
+	if os.Getenv(config.SessionTokenEnv) != "" {
+		flog.Fatal("Unset %s to log out the session stored on this machine", config.SessionTokenEnv)
+	}
+
+	cfg, profile := loadProfile()
+
+	cloudURL, err := resolveCloudURL(fl, c.cloudURL, cfg, profile)
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+
+	settings, err := cfg.Effective(profile)
+	if err != nil {
+		flog.Fatal("Invalid settings: %v", err)
+	}
+
+	cli, err := storedClient(cfg, profile, cloudURL, mustHTTPClient(settings))
+	if err != nil {
+		flog.Fatal("Failed to read session: %v", err)
+	}
+	if cli == nil {
+		flog.Info("Not logged in")
+		return
+	}
+
+	// A token that is already rejected doesn't need revoking, but any
+	// other failure is reported so the user knows the token may still
+	// be valid.
+	err = cli.Logout(context.Background())
+	if err != nil && !client.IsUnauthorized(err) {
+		flog.Error("Failed to revoke session token: %v", err)
+	}
+
+	_, err = config.Update(func(c *config.Config) error {
+		return c.SetSessionToken(profile, "")
+	})
+	if err != nil {
+		flog.Fatal("Failed to delete session token: %v", err)
+	}
+
+	flog.Success("Logged out")
+}
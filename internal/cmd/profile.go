@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cli"
+	"go.coder.com/cloud-agent/internal/config"
+	"go.coder.com/flog"
+)
+
+// profileFlag is set by the global --profile flag.
+var profileFlag string
+
+// loadProfile loads the config document and returns it along with the
+// profile selected by --profile, the environment or `profile use`, in
+// that order. It exits on error.
+func loadProfile() (*config.Config, config.Profile) {
+	cfg, err := config.Load()
+	if err != nil {
+		flog.Fatal("Failed to load config: %v", err)
+	}
+
+	if profileFlag != "" {
+		err := config.ValidateProfile(profileFlag)
+		if err != nil {
+			flog.Fatal("Invalid profile: %v", err)
+		}
+		return cfg, config.Profile(profileFlag)
+	}
+
+	p, err := cfg.ActiveProfile()
+	if err != nil {
+		flog.Fatal("Invalid profile: %v", err)
+	}
+	return cfg, p
+}
+
+// resolveCloudURL returns the Coder Cloud URL to use for the profile:
+// the --cloud-url flag if it was set, otherwise $CODER_CLOUD_URL,
+// otherwise the URL stored in the profile, otherwise the default.
+// Selecting a different URL than the one the profile's session token
+// belongs to is an error, so a token is never sent to the wrong cloud.
+func resolveCloudURL(fl *pflag.FlagSet, flagURL string, cfg *config.Config, p config.Profile) (string, error) {
+	settings, err := cfg.Effective(p)
+	if err != nil {
+		return "", err
+	}
+
+	want := settings.CloudURL
+	if fl.Changed("cloud-url") {
+		want = flagURL
+	}
+
+	// A token from the environment is assumed to match the URL it is
+	// used with.
+	stored := cfg.Profile(p).WithDefaults().CloudURL
+	if sameURL(stored, want) || os.Getenv(config.SessionTokenEnv) != "" {
+		return want, nil
+	}
+
+	token, err := cfg.SessionToken(p)
+	if err != nil {
+		return "", xerrors.Errorf("read session token: %w", err)
+	}
+	if token == "" {
+		return want, nil
+	}
+	return "", xerrors.Errorf("profile %q is logged in to %s, use --profile to select a profile for %s", p, stored, want)
+}
+
+func sameURL(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+type profileCmd struct{}
+
+func (c *profileCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "profile",
+		Usage: "COMMAND",
+		Desc:  "Manage profiles for multiple Coder Cloud accounts and URLs.",
+	}
+}
+
+func (c *profileCmd) Subcommands() []cli.Command {
+	return []cli.Command{
+		&profileListCmd{},
+		&profileUseCmd{},
+		&profileDeleteCmd{},
+	}
+}
+
+func (c *profileCmd) Run(fl *pflag.FlagSet) {
+	fl.Usage()
+}
+
+type profileListCmd struct{}
+
+func (c *profileListCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "list",
+		Usage: "",
+		Desc:  "List profiles. The active profile is marked with '*'.",
+	}
+}
+
+func (c *profileListCmd) Run(fl *pflag.FlagSet) {
+	cfg, active := loadProfile()
+
+	for _, p := range cfg.ProfileNames() {
+		mark := " "
+		if p == active {
+			mark = "*"
+		}
+
+		fmt.Printf("%s %s\t%s\n", mark, p, cfg.Profile(p).WithDefaults().CloudURL)
+	}
+}
+
+type profileUseCmd struct {
+	cloudURL       string
+	codeServerAddr string
+}
+
+func (c *profileUseCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "use",
+		Usage: "NAME",
+		Desc:  "Select the active profile, creating it if it doesn't exist.",
+	}
+}
+
+func (c *profileUseCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVar(&c.cloudURL, "cloud-url", DefaultCloudURL, "The Coder Cloud URL the profile connects to.")
+	fl.StringVar(&c.codeServerAddr, "code-server-addr", "", "The default code-server address for the profile.")
+}
+
+func (c *profileUseCmd) Run(fl *pflag.FlagSet) {
+	name := fl.Arg(0)
+	if name == "" {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	err := config.ValidateProfile(name)
+	if err != nil {
+		flog.Fatal("Invalid profile: %v", err)
+	}
+	p := config.Profile(name)
+
+	var cloudURL string
+	_, err = config.Update(func(cfg *config.Config) error {
+		cloudURL, err = resolveCloudURL(fl, c.cloudURL, cfg, p)
+		if err != nil {
+			return err
+		}
+
+		settings := cfg.Profile(p)
+		settings.CloudURL = cloudURL
+		if c.codeServerAddr != "" {
+			settings.CodeServerAddr = c.codeServerAddr
+		}
+		cfg.CurrentProfile = p
+		return nil
+	})
+	if err != nil {
+		flog.Fatal("Failed to select profile: %v", err)
+	}
+
+	flog.Success("Using profile %q (%s)", name, cloudURL)
+}
+
+type profileDeleteCmd struct{}
+
+func (c *profileDeleteCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "delete",
+		Usage: "NAME",
+		Desc:  "Delete a profile and its session token. Run logout first to revoke the token.",
+	}
+}
+
+func (c *profileDeleteCmd) Run(fl *pflag.FlagSet) {
+	name := fl.Arg(0)
+	if name == "" {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	err := config.ValidateProfile(name)
+	if err != nil {
+		flog.Fatal("Invalid profile: %v", err)
+	}
+
+	_, err = config.Update(func(cfg *config.Config) error {
+		if !cfg.HasProfile(config.Profile(name)) {
+			return xerrors.Errorf("profile %q does not exist", name)
+		}
+		return cfg.DeleteProfile(config.Profile(name))
+	})
+	if err != nil {
+		flog.Fatal("Failed to delete profile: %v", err)
+	}
+
+	flog.Success("Deleted profile %q", name)
+}
@@ -0,0 +1,322 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cli"
+	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/cloud-agent/internal/config"
+	"go.coder.com/flog"
+)
+
+type serversCmd struct{}
+
+func (c *serversCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "servers",
+		Usage: "COMMAND",
+		Desc:  "Manage the servers bound to your Coder Cloud account.",
+	}
+}
+
+func (c *serversCmd) Subcommands() []cli.Command {
+	return []cli.Command{
+		&serversListCmd{},
+		&serversShowCmd{},
+		&serversRenameCmd{},
+		&serversDeleteCmd{},
+		&serversPruneCmd{},
+	}
+}
+
+func (c *serversCmd) Run(fl *pflag.FlagSet) {
+	fl.Usage()
+}
+
+// serversFlags are the flags shared by the servers subcommands.
+type serversFlags struct {
+	cloudURL string
+	output   string
+}
+
+func (f *serversFlags) register(fl *pflag.FlagSet) {
+	fl.StringVar(&f.cloudURL, "cloud-url", DefaultCloudURL, "The Coder Cloud URL to connect to.")
+	fl.StringVarP(&f.output, "output", "o", "table", "The output format, table or json.")
+}
+
+// client returns a client for the active profile after checking the
+// flags. It exits on error.
+func (f *serversFlags) client(fl *pflag.FlagSet) *client.Client {
+	if f.output != "table" && f.output != "json" {
+		flog.Fatal("Unknown output format %q", f.output)
+	}
+
+	cli, _ := mustStoredClient(fl, f.cloudURL)
+	return cli
+}
+
+// print writes the servers to stdout in the selected format.
+func (f *serversFlags) print(servers []client.CodeServer) {
+	err := f.write(os.Stdout, servers)
+	if err != nil {
+		flog.Fatal("Failed to write output: %v", err)
+	}
+}
+
+func (f *serversFlags) write(w io.Writer, servers []client.CodeServer) error {
+	if f.output == "json" {
+		if servers == nil {
+			servers = []client.CodeServer{}
+		}
+		return writeJSON(w, servers)
+	}
+
+	return writeServerTable(w, servers)
+}
+
+// writeJSON writes v to w as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeServerTable writes the servers to w as a table.
+func writeServerTable(w io.Writer, servers []client.CodeServer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tID\tHOSTNAME\tCREATED\tLAST CONNECTED")
+	for _, s := range servers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			s.Name,
+			s.ID,
+			s.Hostname,
+			formatTime(s.CreatedAt),
+			formatTime(s.LastConnectionAt),
+		)
+	}
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// findServer returns the server with the ID or name.
+func findServer(ctx context.Context, cli *client.Client, nameOrID string) (*client.CodeServer, error) {
+	servers, err := cli.ListCodeServers(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("list servers: %w", err)
+	}
+
+	var found []client.CodeServer
+	for _, s := range servers {
+		if s.ID == nameOrID {
+			return &s, nil
+		}
+		if s.Name == nameOrID {
+			found = append(found, s)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, xerrors.Errorf("no server named %q", nameOrID)
+	case 1:
+		return &found[0], nil
+	default:
+		return nil, xerrors.Errorf("%d servers are named %q, use the ID instead", len(found), nameOrID)
+	}
+}
+
+// confirm asks the user a yes or no question on stdin.
+func confirm(format string, args ...interface{}) bool {
+	fmt.Fprintf(os.Stderr, format+" [y/N] ", args...)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+type serversListCmd struct {
+	serversFlags
+}
+
+func (c *serversListCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "list",
+		Usage: "",
+		Desc:  "List the servers bound to your account.",
+	}
+}
+
+func (c *serversListCmd) RegisterFlags(fl *pflag.FlagSet) {
+	c.register(fl)
+}
+
+func (c *serversListCmd) Run(fl *pflag.FlagSet) {
+	cli := c.client(fl)
+
+	servers, err := cli.ListCodeServers(context.Background())
+	if err != nil {
+		flog.Fatal("Failed to list servers: %v", err)
+	}
+
+	c.print(servers)
+}
+
+type serversShowCmd struct {
+	serversFlags
+}
+
+func (c *serversShowCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "show",
+		Usage: "NAME|ID",
+		Desc:  "Show a server bound to your account.",
+	}
+}
+
+func (c *serversShowCmd) RegisterFlags(fl *pflag.FlagSet) {
+	c.register(fl)
+}
+
+func (c *serversShowCmd) Run(fl *pflag.FlagSet) {
+	if fl.NArg() != 1 {
+		fl.Usage()
+		os.Exit(2)
+	}
+	cli := c.client(fl)
+
+	server, err := findServer(context.Background(), cli, fl.Arg(0))
+	if err != nil {
+		flog.Fatal("Failed to find server: %v", err)
+	}
+
+	err = c.write(os.Stdout, server)
+	if err != nil {
+		flog.Fatal("Failed to write output: %v", err)
+	}
+}
+
+// write writes the server to w in the selected format.
+func (c *serversShowCmd) write(w io.Writer, server *client.CodeServer) error {
+	if c.output == "json" {
+		return writeJSON(w, server)
+	}
+
+	_, err := fmt.Fprintf(w, "Name:           %s\n"+
+		"ID:             %s\n"+
+		"Hostname:       %s\n"+
+		"Created:        %s\n"+
+		"Last connected: %s\n",
+		server.Name,
+		server.ID,
+		server.Hostname,
+		formatTime(server.CreatedAt),
+		formatTime(server.LastConnectionAt),
+	)
+	return err
+}
+
+type serversRenameCmd struct {
+	cloudURL string
+}
+
+func (c *serversRenameCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "rename",
+		Usage: "NAME|ID NEW_NAME",
+		Desc:  "Rename a server bound to your account. Its access URL stays the same.",
+	}
+}
+
+func (c *serversRenameCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVar(&c.cloudURL, "cloud-url", DefaultCloudURL, "The Coder Cloud URL to connect to.")
+}
+
+func (c *serversRenameCmd) Run(fl *pflag.FlagSet) {
+	if fl.NArg() != 2 {
+		fl.Usage()
+		os.Exit(2)
+	}
+	name := fl.Arg(1)
+	if !config.ServerNameRx.MatchString(name) {
+		flog.Fatal("Name must conform to regex %s", config.ServerNameRx.String())
+	}
+
+	cli, _ := mustStoredClient(fl, c.cloudURL)
+	ctx := context.Background()
+
+	server, err := findServer(ctx, cli, fl.Arg(0))
+	if err != nil {
+		flog.Fatal("Failed to find server: %v", err)
+	}
+
+	_, err = cli.RenameCodeServer(ctx, server.ID, name)
+	if err != nil {
+		flog.Fatal("Failed to rename server: %v", err)
+	}
+
+	flog.Success("Renamed server %q to %q", server.Name, name)
+}
+
+type serversDeleteCmd struct {
+	cloudURL string
+	yes      bool
+}
+
+func (c *serversDeleteCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "delete",
+		Usage: "NAME|ID",
+		Desc:  "Delete a server from your account. Agents bound to it are disconnected.",
+	}
+}
+
+func (c *serversDeleteCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVar(&c.cloudURL, "cloud-url", DefaultCloudURL, "The Coder Cloud URL to connect to.")
+	fl.BoolVarP(&c.yes, "yes", "y", false, "Don't ask for confirmation.")
+}
+
+func (c *serversDeleteCmd) Run(fl *pflag.FlagSet) {
+	if fl.NArg() != 1 {
+		fl.Usage()
+		os.Exit(2)
+	}
+	cli, _ := mustStoredClient(fl, c.cloudURL)
+	ctx := context.Background()
+
+	server, err := findServer(ctx, cli, fl.Arg(0))
+	if err != nil {
+		flog.Fatal("Failed to find server: %v", err)
+	}
+
+	if !c.yes && !confirm("Delete server %q (%s) on %s?", server.Name, server.ID, server.Hostname) {
+		flog.Info("Aborted")
+		return
+	}
+
+	err = cli.DeleteCodeServer(ctx, server.ID)
+	if err != nil {
+		flog.Fatal("Failed to delete server: %v", err)
+	}
+
+	flog.Success("Deleted server %q", server.Name)
+}
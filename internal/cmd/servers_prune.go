@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cli"
+	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/flog"
+)
+
+type serversPruneCmd struct {
+	cloudURL  string
+	olderThan string
+	hostname  string
+	dryRun    bool
+	yes       bool
+}
+
+func (c *serversPruneCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "prune",
+		Usage: "",
+		Desc: `Delete servers that haven't connected to Coder Cloud for a while.
+Servers that never connected are pruned based on when they were created.`,
+	}
+}
+
+func (c *serversPruneCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVar(&c.cloudURL, "cloud-url", DefaultCloudURL, "The Coder Cloud URL to connect to.")
+	fl.StringVar(&c.olderThan, "older-than", "30d", "Prune servers last connected longer ago than this, e.g. 12h, 30d or 2w.")
+	fl.StringVar(&c.hostname, "hostname", "", "Only prune servers whose hostname matches this glob pattern.")
+	fl.BoolVar(&c.dryRun, "dry-run", false, "Print the servers that would be pruned without deleting them.")
+	fl.BoolVarP(&c.yes, "yes", "y", false, "Don't ask for confirmation.")
+}
+
+func (c *serversPruneCmd) Run(fl *pflag.FlagSet) {
+	age, err := parseAge(c.olderThan)
+	if err != nil {
+		flog.Fatal("Invalid --older-than: %v", err)
+	}
+	if c.hostname != "" {
+		_, err = path.Match(c.hostname, "")
+		if err != nil {
+			flog.Fatal("Invalid --hostname pattern: %v", err)
+		}
+	}
+
+	cli, _ := mustStoredClient(fl, c.cloudURL)
+	ctx := context.Background()
+
+	servers, err := cli.ListCodeServers(ctx)
+	if err != nil {
+		flog.Fatal("Failed to list servers: %v", err)
+	}
+
+	stale := staleServers(servers, time.Now().Add(-age), c.hostname)
+	if len(stale) == 0 {
+		flog.Info("No servers to prune")
+		return
+	}
+
+	_ = writeServerTable(os.Stdout, stale)
+	if c.dryRun {
+		return
+	}
+	if !c.yes && !confirm("Delete these %d servers?", len(stale)) {
+		flog.Info("Aborted")
+		return
+	}
+
+	var failed int
+	for _, s := range stale {
+		err := cli.DeleteCodeServer(ctx, s.ID)
+		if client.IsNotFound(err) {
+			err = nil
+		}
+		if err != nil {
+			flog.Error("Failed to delete server %q: %v", s.Name, err)
+			failed++
+			continue
+		}
+		flog.Info("Deleted server %q", s.Name)
+	}
+	if failed > 0 {
+		flog.Fatal("Failed to delete %d of %d servers", failed, len(stale))
+	}
+
+	flog.Success("Pruned %d servers", len(stale))
+}
+
+// staleServers returns the servers that last connected before cutoff
+// whose hostname matches the pattern, if any.
+func staleServers(servers []client.CodeServer, cutoff time.Time, pattern string) []client.CodeServer {
+	var stale []client.CodeServer
+	for _, s := range servers {
+		last := s.LastConnectionAt
+		if last.IsZero() {
+			last = s.CreatedAt
+		}
+		if !last.Before(cutoff) {
+			continue
+		}
+
+		if pattern != "" {
+			ok, _ := path.Match(pattern, s.Hostname)
+			if !ok {
+				continue
+			}
+		}
+
+		stale = append(stale, s)
+	}
+	return stale
+}
+
+// parseAge parses a duration that may also be given in days or weeks,
+// e.g. 30d or 2w.
+func parseAge(s string) (time.Duration, error) {
+	var unit time.Duration
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+		if d <= 0 {
+			return 0, xerrors.New("must be positive")
+		}
+		return d, nil
+	}
+
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil {
+		return 0, xerrors.Errorf("invalid duration %q", s)
+	}
+	if n <= 0 {
+		return 0, xerrors.New("must be positive")
+	}
+	return time.Duration(n) * unit, nil
+}
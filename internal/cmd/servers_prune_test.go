@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.coder.com/cloud-agent/internal/client"
+)
+
+func TestParseAge(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "30d", want: 30 * 24 * time.Hour},
+		{in: "1d", want: 24 * time.Hour},
+		{in: "2w", want: 14 * 24 * time.Hour},
+		{in: "12h", want: 12 * time.Hour},
+		{in: "90m", want: 90 * time.Minute},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "", err: true},
+		{in: "30", err: true},
+		{in: "d", err: true},
+		{in: "1.5d", err: true},
+		{in: "thirty days", err: true},
+		{in: "0d", err: true},
+		{in: "-1w", err: true},
+		{in: "0s", err: true},
+		{in: "-12h", err: true},
+	} {
+		got, err := parseAge(tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("parseAge(%q) error = %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseAge(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestStaleServers(t *testing.T) {
+	now := time.Now()
+	cutoff := now.Add(-30 * 24 * time.Hour)
+	daysAgo := func(n int) time.Time {
+		return now.Add(-time.Duration(n) * 24 * time.Hour)
+	}
+
+	servers := []client.CodeServer{
+		{ID: "recent", Hostname: "laptop", CreatedAt: daysAgo(100), LastConnectionAt: daysAgo(1)},
+		{ID: "old", Hostname: "laptop", CreatedAt: daysAgo(100), LastConnectionAt: daysAgo(60)},
+		{ID: "old-ci", Hostname: "ci-runner-1", CreatedAt: daysAgo(100), LastConnectionAt: daysAgo(45)},
+		// Servers that never connected are judged by when they were
+		// created.
+		{ID: "never-old", Hostname: "ci-runner-2", CreatedAt: daysAgo(40)},
+		{ID: "never-new", Hostname: "ci-runner-3", CreatedAt: daysAgo(2)},
+		{ID: "at-cutoff", Hostname: "laptop", CreatedAt: daysAgo(100), LastConnectionAt: cutoff},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		pattern string
+		want    []string
+	}{
+		{name: "all", want: []string{"old", "old-ci", "never-old"}},
+		{name: "hostname", pattern: "ci-*", want: []string{"old-ci", "never-old"}},
+		{name: "exact hostname", pattern: "laptop", want: []string{"old"}},
+		{name: "no match", pattern: "desktop", want: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, s := range staleServers(servers, cutoff, tc.pattern) {
+				got = append(got, s.ID)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.coder.com/cloud-agent/internal/client"
+)
+
+// TestServersJSON checks the shape of the JSON output scripts rely on:
+// list prints an array and show a single object.
+func TestServersJSON(t *testing.T) {
+	created := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	server := client.CodeServer{
+		ID:        "abc",
+		UserID:    "user",
+		Name:      "laptop",
+		Hostname:  "laptop.local",
+		CreatedAt: created,
+	}
+	object := map[string]interface{}{
+		"id":                 "abc",
+		"user_id":            "user",
+		"name":               "laptop",
+		"hostname":           "laptop.local",
+		"created_at":         "2021-03-01T12:00:00Z",
+		"last_connection_at": "0001-01-01T00:00:00Z",
+	}
+
+	for _, tc := range []struct {
+		name  string
+		write func(*bytes.Buffer) error
+		want  interface{}
+	}{
+		{
+			name: "list",
+			write: func(b *bytes.Buffer) error {
+				f := &serversFlags{output: "json"}
+				return f.write(b, []client.CodeServer{server})
+			},
+			want: []interface{}{object},
+		},
+		{
+			name: "empty list",
+			write: func(b *bytes.Buffer) error {
+				f := &serversFlags{output: "json"}
+				return f.write(b, nil)
+			},
+			want: []interface{}{},
+		},
+		{
+			name: "show",
+			write: func(b *bytes.Buffer) error {
+				c := &serversShowCmd{serversFlags: serversFlags{output: "json"}}
+				return c.write(b, &server)
+			},
+			want: object,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := tc.write(&b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got interface{}
+			err = json.Unmarshal(b.Bytes(), &got)
+			if err != nil {
+				t.Fatalf("invalid JSON %q: %v", b.String(), err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %s", b.String())
+			}
+		})
+	}
+}
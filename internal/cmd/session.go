@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/cloud-agent/internal/config"
+	"go.coder.com/flog"
+)
+
+// session holds an authenticated client and knows how to log in again
+// when Coder Cloud rejects its session token.
+type session struct {
+	client     *client.Client
+	cfg        *config.Config
+	profile    config.Profile
+	serverName string
+	// headless selects the device code login flow instead of
+	// opening a browser.
+	headless bool
+}
+
+// storedClient returns a client for cloudURL using the profile's
+// session token, or nil if the profile is not logged in.
+func storedClient(cfg *config.Config, p config.Profile, cloudURL string, hc *http.Client) (*client.Client, error) {
+	u, err := url.Parse(cloudURL)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid cloud URL: %w", err)
+	}
+
+	token, err := cfg.SessionToken(p)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, nil
+	}
+
+	return newClient(u, token, hc), nil
+}
+
+// mustStoredClient returns a client for the profile's Coder Cloud
+// using its stored session token. It exits if the profile is not logged
+// in.
+func mustStoredClient(fl *pflag.FlagSet, flagURL string) (*client.Client, config.Profile) {
+	cfg, profile := loadProfile()
+
+	cloudURL, err := resolveCloudURL(fl, flagURL, cfg, profile)
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+
+	settings, err := cfg.Effective(profile)
+	if err != nil {
+		flog.Fatal("Invalid settings: %v", err)
+	}
+
+	cli, err := storedClient(cfg, profile, cloudURL, mustHTTPClient(settings))
+	if err != nil {
+		flog.Fatal("Failed to read session: %v", err)
+	}
+	if cli == nil {
+		flog.Fatal("Not logged in, run the login command first")
+	}
+	return cli, profile
+}
+
+// authenticate returns a session for cloudURL using the profile's
+// session token. The login flow is run if no token is stored or if
+// Coder Cloud rejects the stored token.
+func authenticate(ctx context.Context, cfg *config.Config, p config.Profile, cloudURL *url.URL, hc *http.Client, serverName string, headless bool) (*session, error) {
+	cli := newClient(cloudURL, "", hc)
+
+	token, err := cfg.SessionToken(p)
+	if err != nil {
+		return nil, xerrors.Errorf("read session token: %w", err)
+	}
+	if token == "" {
+		err = checkLatency(ctx, cli)
+		if err != nil {
+			return nil, err
+		}
+		token, err = login(ctx, cfg, p, cli, serverName, headless, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	cli.Token = token
+
+	s := &session{
+		client:     cli,
+		cfg:        cfg,
+		profile:    p,
+		serverName: serverName,
+		headless:   headless,
+	}
+
+	// Validate the token up front so an expired session is caught before
+	// anything else is attempted.
+	err = s.withReauth(ctx, func() error {
+		_, err := s.client.Me(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// withReauth calls fn, logging in again and retrying once if Coder Cloud
+// rejects the session token.
+func (s *session) withReauth(ctx context.Context, fn func() error) error {
+	err := fn()
+	if !client.IsUnauthorized(err) {
+		return err
+	}
+
+	err = s.relogin(ctx)
+	if err != nil {
+		return err
+	}
+
+	return fn()
+}
+
+// relogin runs the login flow and updates the client with the new
+// session token.
+func (s *session) relogin(ctx context.Context) error {
+	flog.Info("Session token rejected, logging in again")
+
+	token, err := login(ctx, s.cfg, s.profile, s.client, s.serverName, s.headless, s.client.Token)
+	if err != nil {
+		return err
+	}
+
+	s.client.Token = token
+	return nil
+}
+
+// login runs the login flow against cli's Coder Cloud and stores the
+// resulting session token in the profile, along with the cloud URL it
+// belongs to. stale is the token known not to work, if any.
+//
+// When several agents need to log in at once only the first one prompts
+// the user and the others pick up the token it stored. The config isn't
+// locked while the user logs in.
+func login(ctx context.Context, cfg *config.Config, p config.Profile, cli *client.Client, serverName string, headless bool, stale string) (string, error) {
+	url := cli.BaseURL.String()
+
+	unlock, err := config.LockLogin(ctx, p, func() {
+		flog.Info("Another agent is logging in to profile %q, waiting for it to finish", p)
+	})
+	if err != nil {
+		return "", xerrors.Errorf("lock login: %w", err)
+	}
+	defer unlock()
+
+	fresh, err := config.Load()
+	if err != nil {
+		return "", xerrors.Errorf("load config: %w", err)
+	}
+	stored, err := fresh.SessionToken(p)
+	if err != nil {
+		return "", xerrors.Errorf("read session token: %w", err)
+	}
+	if stored != "" && stored != stale && sameURL(fresh.Profile(p).WithDefaults().CloudURL, url) {
+		*cfg = *fresh
+		return stored, nil
+	}
+
+	var token string
+	if headless {
+		token, err = cli.LoginDevice(ctx, serverName)
+	} else {
+		token, err = cli.Login(ctx, serverName)
+	}
+	if err != nil {
+		return "", xerrors.Errorf("unable to login: %w", err)
+	}
+
+	fresh, err = config.Update(func(c *config.Config) error {
+		err := c.SetSessionToken(p, token)
+		if err != nil {
+			return xerrors.Errorf("store session token: %w", err)
+		}
+		// A server registered with another cloud doesn't exist in
+		// this one.
+		if !sameURL(c.Profile(p).WithDefaults().CloudURL, url) {
+			c.Profile(p).ServerID = ""
+		}
+		c.Profile(p).CloudURL = url
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	*cfg = *fresh
+	return token, nil
+}
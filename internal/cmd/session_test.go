@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/cloud-agent/internal/config"
+	"go.coder.com/cloud-agent/pkg/cloudtest"
+)
+
+func TestWithReauth(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// login is the token the user logs in with, empty for a new
+		// session.
+		login string
+		// stored is stored by another agent before the session is
+		// revoked.
+		stored    bool
+		wantLogin int32
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "login again", wantLogin: 1, wantCalls: 2},
+		{name: "rejected again", login: "bogus", wantLogin: 1, wantCalls: 2, wantErr: true},
+		{name: "stored by another agent", stored: true, wantCalls: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cloud := cloudtest.New()
+			defer cloud.Close()
+			sess := testSession(t, cloud)
+			sess.headless = true
+			ctx := context.Background()
+
+			var logins int32
+			cloud.SetLogin(func(_, _ string) (string, error) {
+				atomic.AddInt32(&logins, 1)
+				if tc.login != "" {
+					return tc.login, nil
+				}
+				return cloud.AddSession(), nil
+			})
+
+			var stored string
+			if tc.stored {
+				stored = cloud.AddSession()
+				_, err := config.Update(func(c *config.Config) error {
+					return c.SetSessionToken(config.DefaultProfile, stored)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			cloud.RevokeSession(cloudtest.Session)
+
+			calls := 0
+			err := sess.withReauth(ctx, func() error {
+				calls++
+				_, err := sess.client.Me(ctx)
+				return err
+			})
+			if tc.wantErr != client.IsUnauthorized(err) || !tc.wantErr && err != nil {
+				t.Fatalf("got error %v, want unauthorized: %v", err, tc.wantErr)
+			}
+			if calls != tc.wantCalls {
+				t.Fatalf("fn called %d times, want %d", calls, tc.wantCalls)
+			}
+			if n := atomic.LoadInt32(&logins); n != tc.wantLogin {
+				t.Fatalf("logged in %d times, want %d", n, tc.wantLogin)
+			}
+
+			token := sess.client.Token
+			if token == cloudtest.Session || tc.stored && token != stored {
+				t.Fatalf("client has token %q", token)
+			}
+			cfg, err := config.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := cfg.SessionToken(config.DefaultProfile); got != token {
+				t.Fatalf("stored token %q, want %q", got, token)
+			}
+			if got, _ := sess.cfg.SessionToken(config.DefaultProfile); got != token {
+				t.Fatalf("session config has token %q, want %q", got, token)
+			}
+		})
+	}
+}
+
+func TestLoginCloudURL(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// storedURL is the cloud the profile was logged in to.
+		storedURL  string
+		wantLogin  bool
+		wantServer string
+	}{
+		{name: "same cloud", wantServer: "abc"},
+		{name: "other cloud", storedURL: "https://other.example.com", wantLogin: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cloud := cloudtest.New()
+			defer cloud.Close()
+			sess := testSession(t, cloud)
+
+			// A token stored for the same cloud is used as is, while
+			// one for another cloud is worthless here.
+			_, err := config.Update(func(c *config.Config) error {
+				if tc.storedURL != "" {
+					c.Profile(config.DefaultProfile).CloudURL = tc.storedURL
+				}
+				c.Profile(config.DefaultProfile).ServerID = "abc"
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var logins int32
+			cloud.SetLogin(func(_, _ string) (string, error) {
+				atomic.AddInt32(&logins, 1)
+				return cloud.AddSession(), nil
+			})
+
+			token, err := login(context.Background(), sess.cfg, sess.profile, sess.client, "laptop", true, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loggedIn := atomic.LoadInt32(&logins) > 0; loggedIn != tc.wantLogin {
+				t.Fatalf("logged in: %v, want %v", loggedIn, tc.wantLogin)
+			}
+			if !tc.wantLogin && token != cloudtest.Session {
+				t.Fatalf("got token %q, want the stored one", token)
+			}
+
+			cfg, err := config.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			settings := cfg.Profile(config.DefaultProfile)
+			if settings.ServerID != tc.wantServer {
+				t.Fatalf("stored server ID %q, want %q", settings.ServerID, tc.wantServer)
+			}
+			if !sameURL(settings.CloudURL, cloud.URL) {
+				t.Fatalf("stored cloud URL %q, want %q", settings.CloudURL, cloud.URL)
+			}
+			if *sess.cfg.Profile(config.DefaultProfile) != *settings {
+				t.Fatal("session config is out of date")
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.coder.com/flog"
+)
+
+// shutdownContext returns a context canceled once the process is asked
+// to stop with SIGINT or SIGTERM, so the command can shut down
+// gracefully. A second signal exits immediately, calling exit first if
+// it is set. stop releases the signal handler.
+func shutdownContext(exit func()) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			flog.Info("Received %v, shutting down. Send it again to exit immediately.", sig)
+			cancel()
+		case <-done:
+			return
+		}
+
+		select {
+		case sig := <-sigs:
+			flog.Error("Received %v again, exiting", sig)
+			if exit != nil {
+				exit()
+			}
+			os.Exit(exitCode(sig))
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+	}
+}
+
+// exitCode returns the conventional exit code of a process killed by
+// the signal.
+func exitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
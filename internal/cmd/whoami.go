@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/pflag"
+
+	"go.coder.com/cli"
+	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/flog"
+)
+
+type whoamiCmd struct {
+	cloudURL string
+}
+
+func (c *whoamiCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "whoami",
+		Usage: "",
+		Desc:  "Print the user the agent is logged in as.",
+	}
+}
+
+func (c *whoamiCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVar(&c.cloudURL, "cloud-url", DefaultCloudURL, "The Coder Cloud URL to connect to.")
+}
+
+func (c *whoamiCmd) Run(fl *pflag.FlagSet) {
+	cli, profile := mustStoredClient(fl, c.cloudURL)
+
+	user, err := cli.Me(context.Background())
+	if client.IsUnauthorized(err) {
+		flog.Fatal("Session token rejected, run the login command again")
+	}
+	if err != nil {
+		flog.Fatal("Failed to get user: %v", err)
+	}
+
+	fmt.Printf("Profile:  %s\n", profile)
+	fmt.Printf("Cloud:    %s\n", cli.BaseURL)
+	fmt.Printf("Name:     %s\n", user.Name)
+	fmt.Printf("Username: %s\n", user.Username)
+	fmt.Printf("Email:    %s\n", user.Email)
+	fmt.Printf("ID:       %s\n", user.ID)
+	fmt.Printf("Created:  %s\n", user.CreatedAt.Format("2006-01-02"))
+}
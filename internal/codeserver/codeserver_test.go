@@ -0,0 +1,176 @@
+package codeserver
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest"
+
+	"go.coder.com/cloud-agent/internal/backoff"
+)
+
+// helperEnv makes the test binary act as the supervised command.
+const helperEnv = "CODESERVER_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(helperEnv) {
+	case "":
+		os.Exit(m.Run())
+	case "crash":
+		// Record the run so the test can count restarts.
+		fi, err := os.OpenFile(os.Getenv("CODESERVER_TEST_RUNS"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err == nil {
+			fi.WriteString("run\n")
+			fi.Close()
+		}
+		os.Exit(1)
+	case "serve":
+		os.Stdout.WriteString("listening\n")
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	case "stubborn":
+		// Only SIGKILL stops it.
+		signal.Ignore(syscall.SIGTERM)
+		os.Stdout.WriteString("listening\n")
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{in: "code-server --auth none", want: []string{"code-server", "--auth", "none"}},
+		{in: "  code-server\t--auth  none ", want: []string{"code-server", "--auth", "none"}},
+		{in: `code-server '/home/me/my project'`, want: []string{"code-server", "/home/me/my project"}},
+		{in: `a "b \"c\" \d" e\ f ''`, want: []string{"a", `b "c" \d`, "e f", ""}},
+		{in: "", want: nil},
+		{in: `code-server "unterminated`, err: true},
+		{in: `code-server \`, err: true},
+	} {
+		got, err := SplitArgs(tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("SplitArgs(%q) error = %v", tc.in, err)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	args, addr, err := Command("code-server --auth none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Fatalf("got address %q", addr)
+	}
+	want := []string{"code-server", "--auth", "none", "--bind-addr", addr}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("got args %q, want %q", args, want)
+	}
+
+	for _, cmdline := range []string{
+		"code-server --bind-addr 0.0.0.0:9000",
+		"code-server --bind-addr=0.0.0.0:9000",
+	} {
+		args, addr, err := Command(cmdline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := SplitArgs(cmdline)
+		if addr != "0.0.0.0:9000" || !reflect.DeepEqual(args, want) {
+			t.Fatalf("Command(%q) = %q, %q", cmdline, args, addr)
+		}
+	}
+
+	_, _, err = Command("  ")
+	if err == nil {
+		t.Fatal("empty command accepted")
+	}
+}
+
+func newProcess(t *testing.T, mode string) *Process {
+	p := New(slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}), []string{os.Args[0]})
+	p.Env = []string{helperEnv + "=" + mode}
+	p.Restart = backoff.Policy{Initial: 10 * time.Millisecond}
+	return p
+}
+
+func TestProcessRestart(t *testing.T) {
+	runs := t.TempDir() + "/runs"
+	p := newProcess(t, "crash")
+	p.Env = append(p.Env, "CODESERVER_TEST_RUNS="+runs)
+
+	err := p.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		b, _ := os.ReadFile(runs)
+		if strings.Count(string(b), "run") >= 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("command wasn't restarted after crashing")
+}
+
+func TestProcessStop(t *testing.T) {
+	p := newProcess(t, "serve")
+	p.StopTimeout = 10 * time.Second
+
+	err := p.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Let the helper start.
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	p.Stop()
+	if d := time.Since(start); d >= p.StopTimeout {
+		t.Fatalf("command was killed after %s instead of exiting when signaled", d)
+	}
+}
+
+func TestProcessStartError(t *testing.T) {
+	p := New(slogtest.Make(t, nil), []string{"/nonexistent/code-server"})
+	err := p.Start()
+	if err == nil {
+		p.Stop()
+		t.Fatal("started a command that doesn't exist")
+	}
+}
+
+func TestProcessKill(t *testing.T) {
+	p := newProcess(t, "stubborn")
+	p.StopTimeout = 10 * time.Second
+
+	err := p.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Let the helper start ignoring SIGTERM.
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	p.Kill()
+	p.Stop()
+	if d := time.Since(start); d >= p.StopTimeout {
+		t.Fatalf("command outlived Kill for %s", d)
+	}
+}
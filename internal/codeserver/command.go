@@ -0,0 +1,117 @@
+// Package codeserver runs code-server as a child process of the agent,
+// restarting it whenever it crashes.
+package codeserver
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const bindAddrFlag = "--bind-addr"
+
+// Command splits a shell-like command line into arguments and returns
+// the address code-server will listen on. Unless the command sets
+// --bind-addr, a free port on the loopback interface is picked and
+// passed to code-server.
+func Command(cmdline string) (args []string, addr string, err error) {
+	args, err = SplitArgs(cmdline)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(args) == 0 {
+		return nil, "", xerrors.New("empty command")
+	}
+
+	for i, arg := range args {
+		switch {
+		case arg == bindAddrFlag && i+1 < len(args):
+			return args, args[i+1], nil
+		case strings.HasPrefix(arg, bindAddrFlag+"="):
+			return args, strings.TrimPrefix(arg, bindAddrFlag+"="), nil
+		}
+	}
+
+	addr, err = freeAddr()
+	if err != nil {
+		return nil, "", err
+	}
+	return append(args, bindAddrFlag, addr), addr, nil
+}
+
+// freeAddr returns a loopback address with a port nothing listens on.
+// The port is kept across restarts so the address stays the same.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", xerrors.Errorf("find free port: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// SplitArgs splits a command line into arguments like a POSIX shell
+// would, honoring single and double quotes and backslash escapes.
+// Variables, globs and other expansions aren't supported.
+func SplitArgs(s string) ([]string, error) {
+	var (
+		args  []string
+		arg   strings.Builder
+		inArg bool
+		quote rune
+	)
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+				continue
+			}
+			arg.WriteRune(r)
+
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\$`+"`", runes[i+1]):
+				i++
+				arg.WriteRune(runes[i])
+			default:
+				arg.WriteRune(r)
+			}
+
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+
+		case r == '\\':
+			if i+1 == len(runes) {
+				return nil, xerrors.New("trailing backslash")
+			}
+			i++
+			arg.WriteRune(runes[i])
+			inArg = true
+
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, xerrors.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
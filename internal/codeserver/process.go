@@ -0,0 +1,238 @@
+package codeserver
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"cdr.dev/slog"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cloud-agent/internal/backoff"
+)
+
+// Defaults for the fields of Process.
+var (
+	DefaultRestart = backoff.Policy{
+		Initial:    time.Second,
+		Max:        time.Minute,
+		Multiplier: 2,
+		Jitter:     0.2,
+	}
+	DefaultResetAfter  = time.Minute
+	DefaultStopTimeout = 10 * time.Second
+)
+
+// Process runs a command, restarting it with backoff whenever it exits,
+// until it is stopped. Its output is logged line by line.
+type Process struct {
+	Log  slog.Logger
+	Args []string
+	// Env is added to the agent's environment.
+	Env []string
+	// Restart is the delay between restarts.
+	Restart backoff.Policy
+	// ResetAfter is how long the command must run for the restart delay
+	// to start over.
+	ResetAfter time.Duration
+	// StopTimeout is how long the command is given to exit once asked to
+	// by Stop before it is killed.
+	StopTimeout time.Duration
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu sync.Mutex
+	// cmd is the latest run of the command.
+	cmd *exec.Cmd
+}
+
+// New returns a Process running the command with the default restart
+// policy.
+func New(log slog.Logger, args []string) *Process {
+	return &Process{
+		Log:         log,
+		Args:        args,
+		Restart:     DefaultRestart,
+		ResetAfter:  DefaultResetAfter,
+		StopTimeout: DefaultStopTimeout,
+	}
+}
+
+// Start starts the command and keeps restarting it in the background
+// until Stop is called. An error is returned if it couldn't be started
+// at all, e.g. because the executable doesn't exist.
+func (p *Process) Start() error {
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	cmd, exited, err := p.start()
+	if err != nil {
+		return err
+	}
+	go p.supervise(cmd, exited)
+	return nil
+}
+
+// Stop asks the command to exit, killing it if it doesn't within
+// StopTimeout, and waits for it to exit. It is not restarted anymore.
+func (p *Process) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+}
+
+// Kill kills the command right away without waiting for it to exit,
+// for when the agent must exit immediately. It is not restarted anymore.
+func (p *Process) Kill() {
+	p.stopOnce.Do(func() { close(p.stop) })
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd != nil {
+		_ = kill(p.cmd.Process)
+	}
+}
+
+// start starts the command. exited receives the result of waiting for it
+// once its output is logged.
+func (p *Process) start() (*exec.Cmd, <-chan error, error) {
+	cmd := exec.Command(p.Args[0], p.Args[1:]...)
+	cmd.Env = append(os.Environ(), p.Env...)
+	cmd.SysProcAttr = sysProcAttr()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("pipe stdout: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("pipe stderr: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("start %s: %w", p.Args[0], err)
+	}
+
+	p.mu.Lock()
+	p.cmd = cmd
+	p.mu.Unlock()
+
+	log := p.Log.With(slog.F("pid", cmd.Process.Pid))
+	log.Info(context.Background(), "started code-server", slog.F("args", p.Args))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go logLines(&wg, log, "stdout", stdout)
+	go logLines(&wg, log, "stderr", stderr)
+
+	exited := make(chan error, 1)
+	go func() {
+		// Wait closes the pipes, so the output must be read first.
+		wg.Wait()
+		exited <- cmd.Wait()
+	}()
+
+	return cmd, exited, nil
+}
+
+func (p *Process) supervise(cmd *exec.Cmd, exited <-chan error) {
+	defer close(p.done)
+
+	ctx := context.Background()
+	b := backoff.New(p.Restart)
+	for {
+		started := time.Now()
+
+		var err error
+		select {
+		case <-p.stop:
+			p.terminate(cmd, exited)
+			return
+		case err = <-exited:
+		}
+
+		if time.Since(started) >= p.ResetAfter {
+			b.Reset()
+		}
+
+		for {
+			delay, ok := b.Next()
+			if !ok {
+				p.Log.Error(ctx, "giving up restarting code-server", slog.F("restarts", b.Attempt()), slog.Error(err))
+				return
+			}
+			p.Log.Error(ctx, "code-server exited, restarting",
+				slog.F("status", exitStatus(cmd, err)),
+				slog.F("delay", delay.Round(time.Millisecond)),
+			)
+
+			t := time.NewTimer(delay)
+			select {
+			case <-p.stop:
+				t.Stop()
+				return
+			case <-t.C:
+			}
+
+			cmd, exited, err = p.start()
+			if err == nil {
+				break
+			}
+		}
+	}
+}
+
+// terminate asks the command to exit and kills it if it doesn't within
+// StopTimeout.
+func (p *Process) terminate(cmd *exec.Cmd, exited <-chan error) {
+	ctx := context.Background()
+	log := p.Log.With(slog.F("pid", cmd.Process.Pid))
+
+	err := terminate(cmd.Process)
+	if err != nil {
+		log.Warn(ctx, "signal code-server", slog.Error(err))
+	}
+
+	t := time.NewTimer(p.StopTimeout)
+	defer t.Stop()
+	select {
+	case err = <-exited:
+	case <-t.C:
+		log.Warn(ctx, "code-server didn't exit in time, killing it", slog.F("timeout", p.StopTimeout))
+		_ = kill(cmd.Process)
+		err = <-exited
+	}
+	log.Info(ctx, "code-server stopped", slog.F("status", exitStatus(cmd, err)))
+}
+
+// exitStatus describes how the command exited, or why it couldn't be
+// started.
+func exitStatus(cmd *exec.Cmd, err error) string {
+	if cmd == nil || cmd.ProcessState == nil {
+		if err != nil {
+			return err.Error()
+		}
+		return "unknown"
+	}
+	return cmd.ProcessState.String()
+}
+
+// logLines logs every line read from r.
+func logLines(wg *sync.WaitGroup, log slog.Logger, stream string, r io.Reader) {
+	defer wg.Done()
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for sc.Scan() {
+		log.Info(context.Background(), sc.Text(), slog.F("stream", stream))
+	}
+	// Drain what's left of an overlong line so the command doesn't
+	// block writing it.
+	_, _ = io.Copy(io.Discard, r)
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package codeserver
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals can't be sent elsewhere, so the command is always killed.
+
+func sysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func terminate(p *os.Process) error {
+	return p.Kill()
+}
+
+func kill(p *os.Process) error {
+	return p.Kill()
+}
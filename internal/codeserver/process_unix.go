@@ -0,0 +1,24 @@
+//go:build unix
+
+package codeserver
+
+import (
+	"os"
+	"syscall"
+)
+
+// The command runs in its own process group so signals meant for the
+// agent, like ^C in a terminal, reach it only through Stop, and so the
+// processes code-server spawns are stopped with it.
+
+func sysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+func terminate(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGTERM)
+}
+
+func kill(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,652 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	// ConfigFile is the file containing the agent's config document.
+	ConfigFile File = "config.json"
+)
+
+// Version is the version of the config document written by this agent.
+const Version = 1
+
+// Defaults for settings that aren't present in the config document.
+const (
+	DefaultCloudURL            = "https://cloud.coder.com"
+	DefaultCodeServerAddr      = "localhost:8080"
+	DefaultLogLevel            = "info"
+	DefaultLogFormat           = "human"
+	DefaultReconnectDelay      = Duration(time.Second)
+	DefaultReconnectMaxDelay   = Duration(time.Minute)
+	DefaultReconnectMultiplier = 2
+	DefaultReconnectJitter     = 0.2
+	DefaultReconnectResetAfter = Duration(time.Minute)
+	DefaultDrainTimeout        = Duration(10 * time.Second)
+	DefaultKeepaliveInterval   = Duration(15 * time.Second)
+	DefaultWriteTimeout        = Duration(10 * time.Second)
+	DefaultWindowSize          = 256 << 10
+	DefaultPingInterval        = Duration(15 * time.Second)
+	DefaultPingTimeout         = Duration(10 * time.Second)
+	DefaultHealthCheck         = "http"
+	DefaultHealthInterval      = Duration(5 * time.Second)
+	DefaultHealthTimeout       = Duration(2 * time.Second)
+)
+
+// ServerNameRx is the pattern server names must match.
+var ServerNameRx = regexp.MustCompile("^[a-z0-9][a-z0-9_]{0,50}$")
+
+// Config is the agent's config document. It holds the settings of
+// every profile.
+type Config struct {
+	Version        int                   `json:"version"`
+	CurrentProfile Profile               `json:"current_profile,omitempty"`
+	Secrets        SecretSettings        `json:"secrets"`
+	Profiles       map[Profile]*Settings `json:"profiles,omitempty"`
+
+	store SecretStore
+	// stale holds the secrets to delete once the document is saved.
+	stale []staleSecret
+	// legacy lists the files of an older agent the document was built
+	// from, which are removed once it is saved.
+	legacy []File
+}
+
+// Settings are the settings of a single profile. Empty fields take the
+// defaults applied by WithDefaults.
+type Settings struct {
+	CloudURL string `json:"cloud_url,omitempty"`
+	// SessionToken is only set when secrets are stored in the config
+	// document. Use Config.SessionToken to read it.
+	SessionToken   string            `json:"session_token,omitempty"`
+	CodeServerAddr string            `json:"code_server_addr,omitempty"`
+	Password       PasswordSource    `json:"password"`
+	ServerName     string            `json:"server_name,omitempty"`
+	Headless       bool              `json:"headless,omitempty"`
+	Log            LogSettings       `json:"log"`
+	Reconnect      ReconnectSettings `json:"reconnect"`
+	TLS            TLSSettings       `json:"tls"`
+	// Proxy is the URL of the HTTP, HTTPS or SOCKS5 proxy all traffic
+	// to Coder Cloud goes through, with optional basic auth
+	// credentials. $HTTPS_PROXY is used if it is empty. Hosts in
+	// $NO_PROXY are always connected to directly.
+	Proxy string `json:"proxy,omitempty"`
+	// ServerID is the ID of the server bind registered on this machine.
+	// It is reused by later binds so the server keeps its identity and
+	// access URL when its name changes.
+	ServerID string `json:"server_id,omitempty"`
+	// DrainTimeout is how long active IDE connections are given to
+	// finish when bind is asked to shut down.
+	DrainTimeout Duration          `json:"drain_timeout,omitempty"`
+	Keepalive    KeepaliveSettings `json:"keepalive"`
+	Health       HealthSettings    `json:"health"`
+	// Exec is a command line starting code-server, which bind then runs
+	// and restarts whenever it exits. CodeServerAddr is ignored if it
+	// is set.
+	Exec string `json:"exec,omitempty"`
+}
+
+// PasswordSource describes where the code-server password is read from.
+// At most one field may be set.
+type PasswordSource struct {
+	Value string `json:"value,omitempty"`
+	File  string `json:"file,omitempty"`
+	Env   string `json:"env,omitempty"`
+}
+
+// LogSettings configure the agent's structured logs.
+type LogSettings struct {
+	// Level is one of debug, info, warn or error.
+	Level string `json:"level,omitempty"`
+	// Format is one of human or json.
+	Format string `json:"format,omitempty"`
+	// File is the file logs are appended to. Logs are written to
+	// stderr if it is empty.
+	File string `json:"file,omitempty"`
+}
+
+// ReconnectSettings configure how the agent reconnects to Coder Cloud
+// after the connection is disrupted. The delay grows exponentially with
+// every failed attempt.
+type ReconnectSettings struct {
+	// Delay is the time waited before the first reconnect.
+	Delay Duration `json:"delay,omitempty"`
+	// MaxDelay caps the time waited between reconnects.
+	MaxDelay Duration `json:"max_delay,omitempty"`
+	// Multiplier is applied to the delay after every failed attempt. 1
+	// keeps the delay constant. It is a pointer so an explicit value
+	// can be told from an unset one.
+	Multiplier *float64 `json:"multiplier,omitempty"`
+	// Jitter randomizes each delay by up to this fraction. 0 turns it
+	// off.
+	Jitter *float64 `json:"jitter,omitempty"`
+	// MaxAttempts is the number of consecutive failed reconnects after
+	// which the agent gives up. Zero means never give up.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// ResetAfter is how long a connection must stay up for the delay
+	// to start over from Delay.
+	ResetAfter Duration `json:"reset_after,omitempty"`
+}
+
+// KeepaliveSettings configure how the agent detects that its connection
+// to Coder Cloud died, e.g. after a network change left it half-open.
+type KeepaliveSettings struct {
+	// Interval is how often the multiplexed tunnel pings Coder Cloud.
+	Interval Duration `json:"interval,omitempty"`
+	// WriteTimeout is how long a write to the tunnel, including a
+	// ping, may block before the connection is considered dead.
+	WriteTimeout Duration `json:"write_timeout,omitempty"`
+	// WindowSize is the maximum receive window of a stream in bytes.
+	// Larger windows speed up large transfers on high latency links.
+	WindowSize int `json:"window_size,omitempty"`
+	// PingInterval is how often the websocket is pinged.
+	PingInterval Duration `json:"ping_interval,omitempty"`
+	// PingTimeout is how long to wait for a websocket pong before the
+	// connection is considered dead.
+	PingTimeout Duration `json:"ping_timeout,omitempty"`
+}
+
+// HealthSettings configure how bind checks that code-server is up.
+type HealthSettings struct {
+	// Check is http to probe code-server's /healthz endpoint or tcp to
+	// only check that code-server accepts connections.
+	Check string `json:"check,omitempty"`
+	// Interval is how often code-server is checked.
+	Interval Duration `json:"interval,omitempty"`
+	// Timeout bounds a single check.
+	Timeout Duration `json:"timeout,omitempty"`
+	// Wait is how long bind waits for code-server to come up before
+	// registering the server. Bind doesn't wait if it is zero.
+	Wait Duration `json:"wait,omitempty"`
+}
+
+// TLSSettings configure TLS for every connection to Coder Cloud.
+type TLSSettings struct {
+	// CACert is a PEM bundle of certificate authorities trusted in
+	// addition to the system's.
+	CACert string `json:"ca_cert,omitempty"`
+	// ClientCert and ClientKey are the PEM files of the certificate
+	// presented to Coder Cloud for mutual TLS.
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	// InsecureSkipVerify disables verifying Coder Cloud's certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+// Duration is a time.Duration encoded in JSON as a string
+// such as "1m30s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return xerrors.Errorf("duration must be a string such as \"1m30s\": %w", err)
+	}
+
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// Load reads the config document. If it doesn't exist yet, it is
+// migrated from the files written by older agents, or an empty config
+// is returned.
+//
+// The returned config is a snapshot: use Update to modify the document.
+func Load() (*Config, error) {
+	c, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.legacy) > 0 || c.hasPlaintextSecrets() {
+		// Persist the migration under the lock.
+		return Update(func(*Config) error { return nil })
+	}
+	return c, nil
+}
+
+// Update locks the config document, loads it, calls fn to modify it and
+// saves the result. It is safe to call from several processes at once.
+// The saved config is returned.
+func Update(fn func(c *Config) error) (*Config, error) {
+	unlock, err := lock(configLock)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	c, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = fn(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens may have been written before an external secret store was
+	// selected.
+	err = c.moveSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.save()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.deleteStale()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.legacy) > 0 {
+		err = removeLegacy(c.legacy)
+		if err != nil {
+			return nil, xerrors.Errorf("remove migrated files: %w", err)
+		}
+		c.legacy = nil
+	}
+
+	return c, nil
+}
+
+func load() (*Config, error) {
+	b, err := read(string(ConfigFile))
+	if xerrors.Is(err, os.ErrNotExist) {
+		return migrate()
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("read %s: %w", ConfigFile, err)
+	}
+
+	var c Config
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&c)
+	if err != nil {
+		return nil, xerrors.Errorf("parse %s: %w", ConfigFile, err)
+	}
+
+	if c.Version > Version {
+		return nil, xerrors.Errorf("%s has version %d, this agent only supports up to version %d", ConfigFile, c.Version, Version)
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, xerrors.Errorf("invalid %s: %w", ConfigFile, err)
+	}
+
+	return &c, nil
+}
+
+// save validates and writes the config document. The config lock must
+// be held.
+func (c *Config) save() error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+
+	c.Version = Version
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("marshal config: %w", err)
+	}
+
+	return write(string(ConfigFile), 0600, append(b, '\n'))
+}
+
+// Validate returns an error if the config document is invalid.
+func (c *Config) Validate() error {
+	if c.CurrentProfile != "" {
+		err := ValidateProfile(string(c.CurrentProfile))
+		if err != nil {
+			return xerrors.Errorf("current_profile: %w", err)
+		}
+	}
+
+	err := c.Secrets.Validate()
+	if err != nil {
+		return xerrors.Errorf("secrets: %w", err)
+	}
+
+	for name, s := range c.Profiles {
+		err := ValidateProfile(string(name))
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			continue
+		}
+
+		err = s.Validate()
+		if err != nil {
+			return xerrors.Errorf("profile %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Profile returns the settings of the profile, adding an empty profile
+// to the config if it doesn't exist. The returned settings may be
+// modified within Update.
+func (c *Config) Profile(p Profile) *Settings {
+	if p == "" {
+		p = DefaultProfile
+	}
+	if c.Profiles == nil {
+		c.Profiles = make(map[Profile]*Settings)
+	}
+
+	s, ok := c.Profiles[p]
+	if !ok || s == nil {
+		s = &Settings{}
+		c.Profiles[p] = s
+	}
+	return s
+}
+
+// HasProfile reports whether the profile exists.
+func (c *Config) HasProfile(p Profile) bool {
+	if p == DefaultProfile {
+		return true
+	}
+	_, ok := c.Profiles[p]
+	return ok
+}
+
+// DeleteProfile removes the profile and its session token, deselecting
+// it if it is the current profile.
+func (c *Config) DeleteProfile(p Profile) error {
+	err := c.SetSessionToken(p, "")
+	if err != nil {
+		return xerrors.Errorf("delete session token: %w", err)
+	}
+
+	delete(c.Profiles, p)
+	if c.CurrentProfile == p {
+		c.CurrentProfile = ""
+	}
+	return nil
+}
+
+// ProfileNames returns the names of all profiles, sorted. The default
+// profile is always included.
+func (c *Config) ProfileNames() []Profile {
+	names := []Profile{DefaultProfile}
+	for name := range c.Profiles {
+		if name != DefaultProfile {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// Float returns a pointer to f, for setting optional fields.
+func Float(f float64) *float64 {
+	return &f
+}
+
+// WithDefaults returns a copy of the settings with defaults applied to
+// empty fields.
+func (s Settings) WithDefaults() Settings {
+	if s.CloudURL == "" {
+		s.CloudURL = DefaultCloudURL
+	}
+	if s.CodeServerAddr == "" {
+		s.CodeServerAddr = DefaultCodeServerAddr
+	}
+	if s.Log.Level == "" {
+		s.Log.Level = DefaultLogLevel
+	}
+	if s.Log.Format == "" {
+		s.Log.Format = DefaultLogFormat
+	}
+	if s.Reconnect.Delay == 0 {
+		s.Reconnect.Delay = DefaultReconnectDelay
+	}
+	if s.Reconnect.MaxDelay == 0 {
+		s.Reconnect.MaxDelay = DefaultReconnectMaxDelay
+		// A delay above the default cap is kept rather than cut down.
+		if s.Reconnect.MaxDelay < s.Reconnect.Delay {
+			s.Reconnect.MaxDelay = s.Reconnect.Delay
+		}
+	}
+	if s.Reconnect.Multiplier == nil {
+		s.Reconnect.Multiplier = Float(DefaultReconnectMultiplier)
+	}
+	if s.Reconnect.Jitter == nil {
+		s.Reconnect.Jitter = Float(DefaultReconnectJitter)
+	}
+	if s.Reconnect.ResetAfter == 0 {
+		s.Reconnect.ResetAfter = DefaultReconnectResetAfter
+	}
+	if s.DrainTimeout == 0 {
+		s.DrainTimeout = DefaultDrainTimeout
+	}
+	if s.Keepalive.Interval == 0 {
+		s.Keepalive.Interval = DefaultKeepaliveInterval
+	}
+	if s.Keepalive.WriteTimeout == 0 {
+		s.Keepalive.WriteTimeout = DefaultWriteTimeout
+	}
+	if s.Keepalive.WindowSize == 0 {
+		s.Keepalive.WindowSize = DefaultWindowSize
+	}
+	if s.Keepalive.PingInterval == 0 {
+		s.Keepalive.PingInterval = DefaultPingInterval
+	}
+	if s.Keepalive.PingTimeout == 0 {
+		s.Keepalive.PingTimeout = DefaultPingTimeout
+	}
+	if s.Health.Check == "" {
+		s.Health.Check = DefaultHealthCheck
+	}
+	if s.Health.Interval == 0 {
+		s.Health.Interval = DefaultHealthInterval
+	}
+	if s.Health.Timeout == 0 {
+		s.Health.Timeout = DefaultHealthTimeout
+	}
+	return s
+}
+
+// Validate returns an error if any of the settings are invalid. Empty
+// fields are valid.
+func (s Settings) Validate() error {
+	if s.CloudURL != "" {
+		u, err := url.Parse(s.CloudURL)
+		if err != nil {
+			return xerrors.Errorf("cloud_url: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return xerrors.Errorf("cloud_url: scheme must be http or https")
+		}
+	}
+
+	if s.ServerName != "" && !ServerNameRx.MatchString(s.ServerName) {
+		return xerrors.Errorf("server_name: must conform to regex %s", ServerNameRx.String())
+	}
+
+	err := s.Password.validate()
+	if err != nil {
+		return xerrors.Errorf("password: %w", err)
+	}
+
+	switch s.Log.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return xerrors.Errorf("log.level: unknown level %q", s.Log.Level)
+	}
+
+	switch s.Log.Format {
+	case "", "human", "json":
+	default:
+		return xerrors.Errorf("log.format: unknown format %q", s.Log.Format)
+	}
+
+	if (s.TLS.ClientCert == "") != (s.TLS.ClientKey == "") {
+		return xerrors.New("tls: client_cert and client_key must be set together")
+	}
+
+	err = s.Reconnect.validate()
+	if err != nil {
+		return xerrors.Errorf("reconnect.%v", err)
+	}
+
+	if s.DrainTimeout < 0 {
+		return xerrors.New("drain_timeout: must not be negative")
+	}
+
+	err = s.Keepalive.validate()
+	if err != nil {
+		return xerrors.Errorf("keepalive.%v", err)
+	}
+
+	err = s.Health.validate()
+	if err != nil {
+		return xerrors.Errorf("health.%v", err)
+	}
+
+	err = validateProxy(s.Proxy)
+	if err != nil {
+		return xerrors.Errorf("proxy: %w", err)
+	}
+
+	return nil
+}
+
+func (r ReconnectSettings) validate() error {
+	switch {
+	case r.Delay < 0:
+		return xerrors.New("delay: must not be negative")
+	case r.MaxDelay < 0:
+		return xerrors.New("max_delay: must not be negative")
+	case r.MaxDelay != 0 && r.MaxDelay < r.Delay:
+		return xerrors.New("max_delay: must not be less than delay")
+	case r.Multiplier != nil && *r.Multiplier < 1:
+		return xerrors.New("multiplier: must be at least 1")
+	case r.Jitter != nil && (*r.Jitter < 0 || *r.Jitter > 1):
+		return xerrors.New("jitter: must be between 0 and 1")
+	case r.MaxAttempts < 0:
+		return xerrors.New("max_attempts: must not be negative")
+	case r.ResetAfter < 0:
+		return xerrors.New("reset_after: must not be negative")
+	}
+	return nil
+}
+
+func (k KeepaliveSettings) validate() error {
+	switch {
+	case k.Interval < 0:
+		return xerrors.New("interval: must not be negative")
+	case k.WriteTimeout < 0:
+		return xerrors.New("write_timeout: must not be negative")
+	case k.WindowSize != 0 && k.WindowSize < DefaultWindowSize:
+		return xerrors.Errorf("window_size: must be at least %d", DefaultWindowSize)
+	case int64(k.WindowSize) > math.MaxUint32:
+		return xerrors.Errorf("window_size: must be at most %d", uint32(math.MaxUint32))
+	case k.PingInterval < 0:
+		return xerrors.New("ping_interval: must not be negative")
+	case k.PingTimeout < 0:
+		return xerrors.New("ping_timeout: must not be negative")
+	}
+	return nil
+}
+
+func (h HealthSettings) validate() error {
+	switch h.Check {
+	case "", "http", "tcp":
+	default:
+		return xerrors.Errorf("check: unknown check %q", h.Check)
+	}
+
+	switch {
+	case h.Interval < 0:
+		return xerrors.New("interval: must not be negative")
+	case h.Timeout < 0:
+		return xerrors.New("timeout: must not be negative")
+	case h.Wait < 0:
+		return xerrors.New("wait: must not be negative")
+	}
+	return nil
+}
+
+func (p PasswordSource) validate() error {
+	set := 0
+	for _, v := range []string{p.Value, p.File, p.Env} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return xerrors.New("only one of value, file or env may be set")
+	}
+	return nil
+}
+
+// Read returns the password, or an empty string if no source is set.
+func (p PasswordSource) Read() (string, error) {
+	switch {
+	case p.Value != "":
+		return p.Value, nil
+	case p.File != "":
+		b, err := os.ReadFile(p.File)
+		if err != nil {
+			return "", xerrors.Errorf("read password file: %w", err)
+		}
+		return string(bytes.TrimSpace(b)), nil
+	case p.Env != "":
+		return os.Getenv(p.Env), nil
+	default:
+		return "", nil
+	}
+}
+
+func validateProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return xerrors.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return xerrors.New("missing host")
+	}
+	return nil
+}
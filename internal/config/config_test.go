@@ -0,0 +1,290 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+func TestLoadEmpty(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(ConfigDirEnv, dir)
+
+	c, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Profiles) != 0 || c.CurrentProfile != "" {
+		t.Fatalf("got non-empty config %+v", c)
+	}
+	if _, err := os.Stat(filepath.Join(dir, string(ConfigFile))); !xerrors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Load wrote the config document: %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(ConfigDirEnv, dir)
+
+	_, err := Update(func(c *Config) error {
+		c.CurrentProfile = "work"
+		c.Profile("work").CloudURL = "https://cloud.example.com"
+		c.Profile("work").Reconnect.Jitter = Float(0)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, string(ConfigFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("config document has mode %v", fi.Mode().Perm())
+	}
+
+	c, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != Version || c.CurrentProfile != "work" {
+		t.Fatalf("got config %+v", c)
+	}
+	s := c.Profile("work")
+	if s.CloudURL != "https://cloud.example.com" || s.Reconnect.Jitter == nil || *s.Reconnect.Jitter != 0 {
+		t.Fatalf("got profile %+v", s)
+	}
+
+	// A failing update leaves the document alone.
+	_, err = Update(func(c *Config) error {
+		c.CurrentProfile = "other"
+		return xerrors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("error from fn was ignored")
+	}
+	_, err = Update(func(c *Config) error {
+		c.Profile("work").Log.Level = "loud"
+		return nil
+	})
+	if err == nil {
+		t.Fatal("invalid config saved")
+	}
+	c, err = Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CurrentProfile != "work" || c.Profile("work").Log.Level != "" {
+		t.Fatalf("failed updates were saved: %+v", c)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{
+			name:    "syntax",
+			doc:     `{"version": 1,`,
+			wantErr: "parse",
+		},
+		{
+			name:    "unknown field",
+			doc:     `{"version": 1, "profiles": {"default": {"colour": "red"}}}`,
+			wantErr: "unknown field",
+		},
+		{
+			name:    "newer version",
+			doc:     `{"version": 1000}`,
+			wantErr: "this agent only supports up to version",
+		},
+		{
+			name:    "invalid setting",
+			doc:     `{"version": 1, "profiles": {"default": {"reconnect": {"delay": "-1s"}}}}`,
+			wantErr: "reconnect.delay",
+		},
+		{
+			name:    "invalid duration",
+			doc:     `{"version": 1, "profiles": {"default": {"drain_timeout": 30}}}`,
+			wantErr: "duration must be a string",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(ConfigDirEnv, t.TempDir())
+			err := ConfigFile.Write(tc.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = Load()
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:    "current profile",
+			config:  Config{CurrentProfile: "-work"},
+			wantErr: "current_profile",
+		},
+		{
+			name:    "secrets backend",
+			config:  Config{Secrets: SecretSettings{Backend: "vault"}},
+			wantErr: "secrets: backend",
+		},
+		{
+			name:    "profile name",
+			config:  Config{Profiles: map[Profile]*Settings{"my profile": {}}},
+			wantErr: "profile name",
+		},
+		{
+			name:   "nil profile",
+			config: Config{Profiles: map[Profile]*Settings{"work": nil}},
+		},
+		{
+			name:    "cloud url scheme",
+			config:  Config{Profiles: map[Profile]*Settings{"work": {CloudURL: "ftp://cloud"}}},
+			wantErr: `profile "work": cloud_url`,
+		},
+		{
+			name:    "server name",
+			config:  Config{Profiles: map[Profile]*Settings{"work": {ServerName: "My Server"}}},
+			wantErr: "server_name",
+		},
+		{
+			name:    "password sources",
+			config:  Config{Profiles: map[Profile]*Settings{"work": {Password: PasswordSource{Value: "a", Env: "B"}}}},
+			wantErr: "password",
+		},
+		{
+			name:    "client cert without key",
+			config:  Config{Profiles: map[Profile]*Settings{"work": {TLS: TLSSettings{ClientCert: "cert.pem"}}}},
+			wantErr: "client_cert and client_key",
+		},
+		{
+			name:    "max delay below delay",
+			config:  Config{Profiles: map[Profile]*Settings{"work": {Reconnect: ReconnectSettings{Delay: Duration(60e9), MaxDelay: Duration(30e9)}}}},
+			wantErr: "reconnect.max_delay",
+		},
+		{
+			name:    "multiplier",
+			config:  Config{Profiles: map[Profile]*Settings{"work": {Reconnect: ReconnectSettings{Multiplier: Float(0.5)}}}},
+			wantErr: "reconnect.multiplier",
+		},
+		{
+			name:    "jitter",
+			config:  Config{Profiles: map[Profile]*Settings{"work": {Reconnect: ReconnectSettings{Jitter: Float(1.5)}}}},
+			wantErr: "reconnect.jitter",
+		},
+		{
+			name:   "zero jitter",
+			config: Config{Profiles: map[Profile]*Settings{"work": {Reconnect: ReconnectSettings{Jitter: Float(0)}}}},
+		},
+		{
+			name:    "window size",
+			config:  Config{Profiles: map[Profile]*Settings{"work": {Keepalive: KeepaliveSettings{WindowSize: 1}}}},
+			wantErr: "keepalive.window_size",
+		},
+		{
+			name:    "health check",
+			config:  Config{Profiles: map[Profile]*Settings{"work": {Health: HealthSettings{Check: "ping"}}}},
+			wantErr: "health.check",
+		},
+		{
+			name:    "proxy scheme",
+			config:  Config{Profiles: map[Profile]*Settings{"work": {Proxy: "ftp://proxy"}}},
+			wantErr: "proxy",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		in    Settings
+		check func(t *testing.T, s Settings)
+	}{
+		{
+			name: "empty",
+			check: func(t *testing.T, s Settings) {
+				if s.CloudURL != DefaultCloudURL || s.CodeServerAddr != DefaultCodeServerAddr ||
+					s.Reconnect.Delay != DefaultReconnectDelay || s.Reconnect.MaxDelay != DefaultReconnectMaxDelay ||
+					*s.Reconnect.Multiplier != DefaultReconnectMultiplier || *s.Reconnect.Jitter != DefaultReconnectJitter ||
+					s.DrainTimeout != DefaultDrainTimeout || s.Health.Check != DefaultHealthCheck {
+					t.Fatalf("defaults not applied: %+v", s)
+				}
+			},
+		},
+		{
+			name: "set fields kept",
+			in:   Settings{CloudURL: "https://cloud.example.com", DrainTimeout: Duration(1e9)},
+			check: func(t *testing.T, s Settings) {
+				if s.CloudURL != "https://cloud.example.com" || s.DrainTimeout != Duration(1e9) {
+					t.Fatalf("set fields overridden: %+v", s)
+				}
+			},
+		},
+		{
+			name: "explicit zero jitter",
+			in:   Settings{Reconnect: ReconnectSettings{Jitter: Float(0), Multiplier: Float(1)}},
+			check: func(t *testing.T, s Settings) {
+				if *s.Reconnect.Jitter != 0 || *s.Reconnect.Multiplier != 1 {
+					t.Fatalf("explicit values overridden: %+v", s.Reconnect)
+				}
+			},
+		},
+		{
+			name: "delay above default max delay",
+			in:   Settings{Reconnect: ReconnectSettings{Delay: DefaultReconnectMaxDelay * 2}},
+			check: func(t *testing.T, s Settings) {
+				if s.Reconnect.MaxDelay != DefaultReconnectMaxDelay*2 {
+					t.Fatalf("got max delay %v, want the delay", s.Reconnect.MaxDelay)
+				}
+				err := s.Validate()
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			in := tc.in
+			s := tc.in.WithDefaults()
+			if !reflect.DeepEqual(in, tc.in) {
+				t.Fatal("WithDefaults modified its receiver")
+			}
+			tc.check(t, s)
+		})
+	}
+}
@@ -9,11 +9,17 @@ import (
 )
 
 var (
-	// ConfigDir is the directory where agent config is stored.
+	// ConfigDir is the directory where agent config is stored,
+	// relative to the user's config directory. It is ignored if
+	// $CODER_CLOUD_CONFIG_DIR is set.
 	ConfigDir = "coder-cloud"
 )
 
 func dir() (string, error) {
+	if dir := os.Getenv(ConfigDirEnv); dir != "" {
+		return dir, nil
+	}
+
 	conf, err := os.UserConfigDir()
 	if runtime.GOOS == "darwin" {
 		// No one uses macOS's ~/Library for CLI apps...
@@ -59,14 +65,48 @@ func open(path string, flag int, mode os.FileMode) (*os.File, error) {
 	return os.OpenFile(path, flag, mode)
 }
 
+// write atomically replaces the file by writing to a temporary file in
+// the same directory and renaming it, so readers never see a partially
+// written file.
 func write(path string, mode os.FileMode, dat []byte) error {
-	fi, err := open(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, mode)
+	dir, err := dir()
+	if err != nil {
+		return err
+	}
+
+	path = filepath.Join(dir, path)
+
+	err = os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return err
+	}
+
+	fi, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
 	if err != nil {
 		return err
 	}
+	// Removing fails harmlessly once the file has been renamed.
+	defer os.Remove(fi.Name())
 	defer fi.Close()
+
+	err = fi.Chmod(mode)
+	if err != nil {
+		return err
+	}
 	_, err = fi.Write(dat)
-	return err
+	if err != nil {
+		return err
+	}
+	err = fi.Sync()
+	if err != nil {
+		return err
+	}
+	err = fi.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fi.Name(), path)
 }
 
 func read(path string) ([]byte, error) {
@@ -86,3 +126,12 @@ func rm(path string) error {
 
 	return os.Remove(filepath.Join(dir, path))
 }
+
+func rmAll(path string) error {
+	dir, err := dir()
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(dir, path))
+}
@@ -0,0 +1,11 @@
+// Package config reads and writes the agent's configuration.
+//
+// Settings are stored per profile in a JSON document in the config
+// directory. Each setting is resolved in the following order, the first
+// one that is set winning:
+//
+//  1. command line flags
+//  2. CODER_CLOUD_* environment variables
+//  3. the active profile in the config document
+//  4. defaults
+package config
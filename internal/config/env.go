@@ -0,0 +1,116 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Environment variables overriding settings from the config document.
+const (
+	SessionTokenEnv         = "CODER_CLOUD_SESSION_TOKEN"
+	CloudURLEnv             = "CODER_CLOUD_URL"
+	CodeServerAddrEnv       = "CODER_CLOUD_CODE_SERVER_ADDR"
+	PasswordEnv             = "CODER_CLOUD_PASSWORD"
+	ServerNameEnv           = "CODER_CLOUD_SERVER_NAME"
+	HeadlessEnv             = "CODER_CLOUD_HEADLESS"
+	CACertEnv               = "CODER_CLOUD_CA_CERT"
+	ClientCertEnv           = "CODER_CLOUD_CLIENT_CERT"
+	ClientKeyEnv            = "CODER_CLOUD_CLIENT_KEY"
+	InsecureSkipVerifyEnv   = "CODER_CLOUD_INSECURE_SKIP_VERIFY"
+	ProxyEnv                = "CODER_CLOUD_PROXY"
+	LogLevelEnv             = "CODER_CLOUD_LOG_LEVEL"
+	LogFormatEnv            = "CODER_CLOUD_LOG_FORMAT"
+	LogFileEnv              = "CODER_CLOUD_LOG_FILE"
+	ReconnectDelayEnv       = "CODER_CLOUD_RECONNECT_DELAY"
+	ReconnectMaxDelayEnv    = "CODER_CLOUD_RECONNECT_MAX_DELAY"
+	ReconnectMaxAttemptsEnv = "CODER_CLOUD_RECONNECT_MAX_ATTEMPTS"
+	DrainTimeoutEnv         = "CODER_CLOUD_DRAIN_TIMEOUT"
+	ExecEnv                 = "CODER_CLOUD_EXEC"
+	// ConfigDirEnv overrides the directory the config document and
+	// other agent files are stored in.
+	ConfigDirEnv = "CODER_CLOUD_CONFIG_DIR"
+)
+
+// Effective returns the settings of the profile with environment
+// overrides and defaults applied. Flags take precedence over the
+// returned settings and must be applied by the caller. Callers whose
+// flags must be validated against other settings should apply them to
+// the result of WithEnv instead, and only then apply defaults.
+func (c *Config) Effective(p Profile) (Settings, error) {
+	s, err := c.Profile(p).WithEnv()
+	if err != nil {
+		return Settings{}, err
+	}
+	return s.WithDefaults(), nil
+}
+
+// WithEnv returns a copy of the settings with the CODER_CLOUD_*
+// environment variables that are set applied.
+func (s Settings) WithEnv() (Settings, error) {
+	for env, v := range map[string]*string{
+		SessionTokenEnv:   &s.SessionToken,
+		CloudURLEnv:       &s.CloudURL,
+		CodeServerAddrEnv: &s.CodeServerAddr,
+		ServerNameEnv:     &s.ServerName,
+		LogLevelEnv:       &s.Log.Level,
+		LogFormatEnv:      &s.Log.Format,
+		LogFileEnv:        &s.Log.File,
+		CACertEnv:         &s.TLS.CACert,
+		ClientCertEnv:     &s.TLS.ClientCert,
+		ClientKeyEnv:      &s.TLS.ClientKey,
+		ProxyEnv:          &s.Proxy,
+		ExecEnv:           &s.Exec,
+	} {
+		if val := os.Getenv(env); val != "" {
+			*v = val
+		}
+	}
+
+	if val := os.Getenv(PasswordEnv); val != "" {
+		s.Password = PasswordSource{Value: val}
+	}
+
+	for env, v := range map[string]*bool{
+		HeadlessEnv:           &s.Headless,
+		InsecureSkipVerifyEnv: &s.TLS.InsecureSkipVerify,
+	} {
+		if val := os.Getenv(env); val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return Settings{}, xerrors.Errorf("$%s: %w", env, err)
+			}
+			*v = b
+		}
+	}
+
+	for env, v := range map[string]*Duration{
+		ReconnectDelayEnv:    &s.Reconnect.Delay,
+		ReconnectMaxDelayEnv: &s.Reconnect.MaxDelay,
+		DrainTimeoutEnv:      &s.DrainTimeout,
+	} {
+		if val := os.Getenv(env); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return Settings{}, xerrors.Errorf("$%s: %w", env, err)
+			}
+			*v = Duration(d)
+		}
+	}
+
+	if val := os.Getenv(ReconnectMaxAttemptsEnv); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return Settings{}, xerrors.Errorf("$%s: %w", ReconnectMaxAttemptsEnv, err)
+		}
+		s.Reconnect.MaxAttempts = n
+	}
+
+	err := s.Validate()
+	if err != nil {
+		return Settings{}, xerrors.Errorf("invalid environment: %w", err)
+	}
+	return s, nil
+}
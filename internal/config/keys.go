@@ -0,0 +1,376 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Sources of a setting's value, as reported by Entry.Source.
+const (
+	SourceEnv     = "env"
+	SourceConfig  = "config"
+	SourceDefault = "default"
+)
+
+// Redacted replaces the value of secret settings in listings.
+const Redacted = "<redacted>"
+
+// Entry is a setting and where its effective value comes from.
+type Entry struct {
+	Key    string
+	Value  string
+	Source string
+	Secret bool
+}
+
+// key is a setting addressable by name, e.g. with `config set`.
+type key struct {
+	name   string
+	secret bool
+	get    func(c *Config, s *Settings) string
+	set    func(c *Config, s *Settings, v string) error
+}
+
+func stringKey(name string, field func(s *Settings) *string) key {
+	return key{
+		name: name,
+		get: func(_ *Config, s *Settings) string {
+			return *field(s)
+		},
+		set: func(_ *Config, s *Settings, v string) error {
+			*field(s) = v
+			return nil
+		},
+	}
+}
+
+var keys = []key{
+	stringKey("cloud_url", func(s *Settings) *string { return &s.CloudURL }),
+	stringKey("code_server_addr", func(s *Settings) *string { return &s.CodeServerAddr }),
+	stringKey("server_name", func(s *Settings) *string { return &s.ServerName }),
+	stringKey("server_id", func(s *Settings) *string { return &s.ServerID }),
+	boolKey("headless", func(s *Settings) *bool { return &s.Headless }),
+	secretKey(stringKey("password.value", func(s *Settings) *string { return &s.Password.Value })),
+	stringKey("password.file", func(s *Settings) *string { return &s.Password.File }),
+	stringKey("password.env", func(s *Settings) *string { return &s.Password.Env }),
+	stringKey("log.level", func(s *Settings) *string { return &s.Log.Level }),
+	stringKey("log.format", func(s *Settings) *string { return &s.Log.Format }),
+	stringKey("log.file", func(s *Settings) *string { return &s.Log.File }),
+	stringKey("tls.ca_cert", func(s *Settings) *string { return &s.TLS.CACert }),
+	stringKey("tls.client_cert", func(s *Settings) *string { return &s.TLS.ClientCert }),
+	stringKey("tls.client_key", func(s *Settings) *string { return &s.TLS.ClientKey }),
+	boolKey("tls.insecure_skip_verify", func(s *Settings) *bool { return &s.TLS.InsecureSkipVerify }),
+	// The proxy URL may embed credentials.
+	secretKey(stringKey("proxy", func(s *Settings) *string { return &s.Proxy })),
+	durationKey("reconnect.delay", func(s *Settings) *Duration { return &s.Reconnect.Delay }),
+	durationKey("reconnect.max_delay", func(s *Settings) *Duration { return &s.Reconnect.MaxDelay }),
+	floatKey("reconnect.multiplier", func(s *Settings) **float64 { return &s.Reconnect.Multiplier }),
+	floatKey("reconnect.jitter", func(s *Settings) **float64 { return &s.Reconnect.Jitter }),
+	intKey("reconnect.max_attempts", func(s *Settings) *int { return &s.Reconnect.MaxAttempts }),
+	durationKey("reconnect.reset_after", func(s *Settings) *Duration { return &s.Reconnect.ResetAfter }),
+	durationKey("drain_timeout", func(s *Settings) *Duration { return &s.DrainTimeout }),
+	durationKey("keepalive.interval", func(s *Settings) *Duration { return &s.Keepalive.Interval }),
+	durationKey("keepalive.write_timeout", func(s *Settings) *Duration { return &s.Keepalive.WriteTimeout }),
+	intKey("keepalive.window_size", func(s *Settings) *int { return &s.Keepalive.WindowSize }),
+	durationKey("keepalive.ping_interval", func(s *Settings) *Duration { return &s.Keepalive.PingInterval }),
+	durationKey("keepalive.ping_timeout", func(s *Settings) *Duration { return &s.Keepalive.PingTimeout }),
+	stringKey("health.check", func(s *Settings) *string { return &s.Health.Check }),
+	durationKey("health.interval", func(s *Settings) *Duration { return &s.Health.Interval }),
+	durationKey("health.timeout", func(s *Settings) *Duration { return &s.Health.Timeout }),
+	durationKey("health.wait", func(s *Settings) *Duration { return &s.Health.Wait }),
+	stringKey("exec", func(s *Settings) *string { return &s.Exec }),
+	{
+		name:   "session_token",
+		secret: true,
+		get: func(_ *Config, s *Settings) string {
+			return s.SessionToken
+		},
+		// Set through Config.SetSessionToken so the secret store
+		// is honored.
+	},
+	// The remaining keys apply to the whole config document rather
+	// than a profile.
+	{
+		name: "current_profile",
+		get: func(c *Config, _ *Settings) string {
+			return string(c.CurrentProfile)
+		},
+		set: func(c *Config, _ *Settings, v string) error {
+			c.CurrentProfile = Profile(v)
+			return nil
+		},
+	},
+	{
+		name: "secrets.backend",
+		get: func(c *Config, _ *Settings) string {
+			return c.Secrets.Backend
+		},
+		set: func(c *Config, _ *Settings, v string) error {
+			return c.SetSecretBackend(v)
+		},
+	},
+	{
+		name:   "secrets.passphrase.value",
+		secret: true,
+		get: func(c *Config, _ *Settings) string {
+			return c.Secrets.Passphrase.Value
+		},
+		set: func(c *Config, _ *Settings, v string) error {
+			c.Secrets.Passphrase.Value = v
+			return nil
+		},
+	},
+	{
+		name: "secrets.passphrase.file",
+		get: func(c *Config, _ *Settings) string {
+			return c.Secrets.Passphrase.File
+		},
+		set: func(c *Config, _ *Settings, v string) error {
+			c.Secrets.Passphrase.File = v
+			return nil
+		},
+	},
+	{
+		name: "secrets.passphrase.env",
+		get: func(c *Config, _ *Settings) string {
+			return c.Secrets.Passphrase.Env
+		},
+		set: func(c *Config, _ *Settings, v string) error {
+			c.Secrets.Passphrase.Env = v
+			return nil
+		},
+	},
+}
+
+func secretKey(k key) key {
+	k.secret = true
+	return k
+}
+
+func durationKey(name string, field func(s *Settings) *Duration) key {
+	return key{
+		name: name,
+		get: func(_ *Config, s *Settings) string {
+			if *field(s) == 0 {
+				return ""
+			}
+			return time.Duration(*field(s)).String()
+		},
+		set: func(_ *Config, s *Settings, v string) error {
+			if v == "" {
+				*field(s) = 0
+				return nil
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			*field(s) = Duration(d)
+			return nil
+		},
+	}
+}
+
+func boolKey(name string, field func(s *Settings) *bool) key {
+	return key{
+		name: name,
+		get: func(_ *Config, s *Settings) string {
+			if !*field(s) {
+				return ""
+			}
+			return "true"
+		},
+		set: func(_ *Config, s *Settings, v string) error {
+			if v == "" {
+				*field(s) = false
+				return nil
+			}
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			*field(s) = b
+			return nil
+		},
+	}
+}
+
+// floatKey is a setting whose zero value is meaningful, so it is unset
+// when nil.
+func floatKey(name string, field func(s *Settings) **float64) key {
+	return key{
+		name: name,
+		get: func(_ *Config, s *Settings) string {
+			if *field(s) == nil {
+				return ""
+			}
+			return strconv.FormatFloat(**field(s), 'g', -1, 64)
+		},
+		set: func(_ *Config, s *Settings, v string) error {
+			if v == "" {
+				*field(s) = nil
+				return nil
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return err
+			}
+			*field(s) = &f
+			return nil
+		},
+	}
+}
+
+func intKey(name string, field func(s *Settings) *int) key {
+	return key{
+		name: name,
+		get: func(_ *Config, s *Settings) string {
+			if *field(s) == 0 {
+				return ""
+			}
+			return strconv.Itoa(*field(s))
+		},
+		set: func(_ *Config, s *Settings, v string) error {
+			if v == "" {
+				*field(s) = 0
+				return nil
+			}
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			*field(s) = i
+			return nil
+		},
+	}
+}
+
+func findKey(name string) (key, error) {
+	for _, k := range keys {
+		if k.name == name {
+			return k, nil
+		}
+	}
+	return key{}, xerrors.Errorf("unknown key %q", name)
+}
+
+// Keys returns the names of all settings.
+func Keys() []string {
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, k.name)
+	}
+	return names
+}
+
+// IsSecret reports whether the setting holds a secret that should be
+// redacted when displayed.
+func IsSecret(name string) bool {
+	k, err := findKey(name)
+	return err == nil && k.secret
+}
+
+// Get returns the value of the setting stored in the config document
+// for the profile. Environment overrides and defaults are not applied.
+func (c *Config) Get(p Profile, name string) (string, error) {
+	k, err := findKey(name)
+	if err != nil {
+		return "", err
+	}
+
+	if k.name == "session_token" {
+		return c.storedSessionToken(p)
+	}
+	return k.get(c, c.Profile(p)), nil
+}
+
+// Set sets the setting for the profile. An empty value unsets it. It
+// must be called within Update.
+func (c *Config) Set(p Profile, name, value string) error {
+	k, err := findKey(name)
+	if err != nil {
+		return err
+	}
+
+	if k.name == "session_token" {
+		return c.SetSessionToken(p, value)
+	}
+
+	s := c.Profile(p)
+	prevSettings, prevConfig := *s, *c
+	err = k.set(c, s, value)
+	if err != nil {
+		return xerrors.Errorf("%s: %w", name, err)
+	}
+
+	err = c.Validate()
+	if err != nil {
+		*s, *c = prevSettings, prevConfig
+		return err
+	}
+	return nil
+}
+
+// Unset removes the setting from the profile. It must be called within
+// Update.
+func (c *Config) Unset(p Profile, name string) error {
+	return c.Set(p, name, "")
+}
+
+// List returns every setting of the profile along with its effective
+// value and where it comes from. Secret values are redacted.
+func (c *Config) List(p Profile) ([]Entry, error) {
+	stored := *c.Profile(p)
+	token, err := c.storedSessionToken(p)
+	if err != nil {
+		return nil, err
+	}
+	stored.SessionToken = token
+
+	env, err := stored.WithEnv()
+	if err != nil {
+		return nil, err
+	}
+	if v := os.Getenv(SessionTokenEnv); v != "" {
+		env.SessionToken = v
+	}
+	defaults := env.WithDefaults()
+
+	entries := make([]Entry, 0, len(keys))
+	for _, k := range keys {
+		e := Entry{
+			Key:    k.name,
+			Value:  k.get(c, &defaults),
+			Source: SourceDefault,
+			Secret: k.secret,
+		}
+		switch {
+		case k.get(c, &env) != k.get(c, &stored):
+			e.Source = SourceEnv
+		case k.get(c, &stored) != "":
+			e.Source = SourceConfig
+		}
+		if e.Value == "" {
+			e.Source = ""
+		}
+		if e.Secret && e.Value != "" {
+			e.Value = Redacted
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Path returns the path of the config document.
+func Path() (string, error) {
+	dir, err := dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, string(ConfigFile)), nil
+}
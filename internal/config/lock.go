@@ -0,0 +1,128 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrLocked is returned when a lock is held by another process.
+var ErrLocked = xerrors.New("locked by another process")
+
+const (
+	configLock  = "config.lock"
+	secretsLock = "secrets.lock"
+	locksDir    = "locks"
+
+	// lockPollInterval is how often LockLogin retries a held lock.
+	lockPollInterval = 100 * time.Millisecond
+)
+
+// lock takes an exclusive advisory lock on the named file in the config
+// directory, blocking until it is available. The lock is released by
+// calling unlock or when the process exits.
+func lock(path string) (unlock func(), err error) {
+	fi, err := open(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, xerrors.Errorf("open lock: %w", err)
+	}
+
+	err = flock(fi, true)
+	if err != nil {
+		fi.Close()
+		return nil, xerrors.Errorf("lock %s: %w", path, err)
+	}
+
+	return func() {
+		_ = funlock(fi)
+		fi.Close()
+	}, nil
+}
+
+// tryLock is like lock but returns ErrLocked instead of blocking.
+func tryLock(path string) (fi *os.File, unlock func(), err error) {
+	fi, err = open(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("open lock: %w", err)
+	}
+
+	err = flock(fi, false)
+	if err != nil {
+		fi.Close()
+		return nil, nil, err
+	}
+
+	return fi, func() {
+		_ = funlock(fi)
+		fi.Close()
+	}, nil
+}
+
+// LockServer takes a lock for binding the profile's server on this
+// machine. A profile stores the ID of a single server, so only one agent
+// may serve with it at a time. If another agent holds the lock, an error
+// wrapping ErrLocked and naming the server it serves and its PID is
+// returned.
+func LockServer(p Profile, name string) (unlock func(), err error) {
+	path := filepath.Join(locksDir, fmt.Sprintf("%s.lock", p))
+
+	fi, unlock, err := tryLock(path)
+	if xerrors.Is(err, ErrLocked) {
+		b, _ := read(path)
+		fields := strings.Fields(string(b))
+		if len(fields) < 2 {
+			return nil, xerrors.Errorf("profile %q: %w", p, err)
+		}
+		return nil, xerrors.Errorf("profile %q is serving server %q in pid %s: %w", p, fields[1], fields[0], err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Record our PID and server so the next agent can report who holds
+	// the lock.
+	err = fi.Truncate(0)
+	if err == nil {
+		_, err = fi.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), name)), 0)
+	}
+	if err != nil {
+		unlock()
+		return nil, xerrors.Errorf("write lock: %w", err)
+	}
+
+	return unlock, nil
+}
+
+// LockLogin takes a lock for logging in to the profile, so when several
+// agents need to log in at once only one of them prompts the user. If
+// another agent holds the lock, waiting is called and LockLogin blocks
+// until the lock is released or ctx is canceled.
+func LockLogin(ctx context.Context, p Profile, waiting func()) (unlock func(), err error) {
+	path := filepath.Join(locksDir, fmt.Sprintf("%s.login.lock", p))
+
+	_, unlock, err = tryLock(path)
+	if !xerrors.Is(err, ErrLocked) {
+		return unlock, err
+	}
+	waiting()
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		_, unlock, err = tryLock(path)
+		if !xerrors.Is(err, ErrLocked) {
+			return unlock, err
+		}
+	}
+}
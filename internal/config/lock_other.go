@@ -0,0 +1,16 @@
+//go:build !unix
+
+package config
+
+import "os"
+
+// Advisory locks are only implemented on unix. Elsewhere locking is a
+// no-op and concurrent agents are not detected.
+
+func flock(fi *os.File, block bool) error {
+	return nil
+}
+
+func funlock(fi *os.File) error {
+	return nil
+}
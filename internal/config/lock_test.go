@@ -0,0 +1,197 @@
+//go:build unix
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+func TestLock(t *testing.T) {
+	t.Setenv(ConfigDirEnv, t.TempDir())
+
+	unlock, err := lock(configLock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = tryLock(configLock)
+	if !xerrors.Is(err, ErrLocked) {
+		t.Fatalf("got %v while locked, want ErrLocked", err)
+	}
+
+	locked := make(chan func(), 1)
+	go func() {
+		unlock, err := lock(configLock)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock was taken twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case unlock := <-locked:
+		if unlock != nil {
+			unlock()
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("lock wasn't taken once released")
+	}
+}
+
+func TestUpdateContention(t *testing.T) {
+	t.Setenv(ConfigDirEnv, t.TempDir())
+
+	const writers = 20
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	// Readers must never see a partially written document.
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(readErr)
+				return
+			default:
+			}
+			_, err := load()
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := Update(func(c *Config) error {
+				c.Profile(Profile(fmt.Sprintf("p%d", i))).ServerName = "server"
+				// Widen the window for lost updates.
+				time.Sleep(time.Millisecond)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	if err := <-readErr; err != nil {
+		t.Fatalf("read a partial config: %v", err)
+	}
+
+	c, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Profiles) != writers {
+		t.Fatalf("got %d profiles, want %d: updates were lost", len(c.Profiles), writers)
+	}
+}
+
+func TestLockServer(t *testing.T) {
+	t.Setenv(ConfigDirEnv, t.TempDir())
+
+	unlock, err := LockServer("work", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The profile stores a single server ID, so even another server is
+	// refused.
+	for _, name := range []string{"laptop", "desktop"} {
+		_, err = LockServer("work", name)
+		if !xerrors.Is(err, ErrLocked) {
+			t.Fatalf("locked %q: got %v, want ErrLocked", name, err)
+		}
+		want := fmt.Sprintf(`profile "work" is serving server "laptop" in pid %d`, os.Getpid())
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("got %q, want it to contain %q", err, want)
+		}
+	}
+
+	// Other profiles are bound independently.
+	other, err := LockServer("default", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	unlock()
+	unlock, err = LockServer("work", "desktop")
+	if err != nil {
+		t.Fatalf("lock wasn't released: %v", err)
+	}
+	unlock()
+}
+
+func TestLockLogin(t *testing.T) {
+	t.Setenv(ConfigDirEnv, t.TempDir())
+	ctx := context.Background()
+
+	unlock, err := LockLogin(ctx, "work", func() { t.Error("waited for a free lock") })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The config stays unlocked while logging in.
+	_, err = Update(func(*Config) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waiting := make(chan struct{})
+	locked := make(chan error, 1)
+	go func() {
+		unlock, err := LockLogin(ctx, "work", func() { close(waiting) })
+		if err == nil {
+			unlock()
+		}
+		locked <- err
+	}()
+	select {
+	case <-waiting:
+	case <-time.After(10 * time.Second):
+		t.Fatal("waiting wasn't called")
+	}
+
+	unlock()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("lock wasn't taken once released")
+	}
+
+	unlock, err = LockLogin(ctx, "work", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	_, err = LockLogin(ctx, "work", cancel)
+	if !xerrors.Is(err, context.Canceled) {
+		t.Fatalf("got %v after canceling, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package config
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/xerrors"
+)
+
+func flock(fi *os.File, block bool) error {
+	how := syscall.LOCK_EX
+	if !block {
+		how |= syscall.LOCK_NB
+	}
+
+	for {
+		err := syscall.Flock(int(fi.Fd()), how)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case xerrors.Is(err, syscall.EWOULDBLOCK):
+			return ErrLocked
+		}
+		return err
+	}
+}
+
+func funlock(fi *os.File) error {
+	return syscall.Flock(int(fi.Fd()), syscall.LOCK_UN)
+}
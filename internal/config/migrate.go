@@ -0,0 +1,129 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/xerrors"
+)
+
+// Files written by agents before the config document existed.
+var (
+	legacySessionToken   File = "session"
+	legacyCloudURL       File = "cloud_url"
+	legacyCodeServerAddr File = "code_server_addr"
+	legacyProfile        File = "profile"
+)
+
+const legacyProfilesDir = "profiles"
+
+// migrate builds a config document from the files written by older
+// agents. The files it migrates are recorded so they can be removed once
+// the document has been saved.
+func migrate() (*Config, error) {
+	c := &Config{Version: Version}
+
+	err := c.migrateProfile(DefaultProfile, "")
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := dir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, legacyProfilesDir))
+	if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || ValidateProfile(e.Name()) != nil {
+			continue
+		}
+
+		err := c.migrateProfile(Profile(e.Name()), filepath.Join(legacyProfilesDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	current, err := readLegacy(legacyProfile)
+	if err != nil {
+		return nil, err
+	}
+	if current != "" && ValidateProfile(current) == nil {
+		c.CurrentProfile = Profile(current)
+		c.legacy = append(c.legacy, legacyProfile)
+	}
+
+	return c, nil
+}
+
+// removeLegacy removes the migrated files of older agents along with
+// the profile directories they leave empty. Any other file is kept.
+func removeLegacy(files []File) error {
+	for _, f := range files {
+		err := f.Delete()
+		if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	dir, err := dir()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if d := filepath.Dir(string(f)); d != "." {
+			// Removing fails if the directory isn't empty.
+			_ = os.Remove(filepath.Join(dir, d))
+		}
+	}
+	_ = os.Remove(filepath.Join(dir, legacyProfilesDir))
+	return nil
+}
+
+// migrateProfile reads the legacy files of a profile stored in dir into
+// c.
+func (c *Config) migrateProfile(p Profile, dir string) error {
+	var (
+		s     Settings
+		files []File
+	)
+	for f, v := range map[File]*string{
+		legacySessionToken:   &s.SessionToken,
+		legacyCloudURL:       &s.CloudURL,
+		legacyCodeServerAddr: &s.CodeServerAddr,
+	} {
+		f = File(filepath.Join(dir, string(f)))
+		val, err := readLegacy(f)
+		if err != nil {
+			return err
+		}
+		if val != "" {
+			*v = val
+			files = append(files, f)
+		}
+	}
+
+	if s == (Settings{}) {
+		return nil
+	}
+	*c.Profile(p) = s
+	c.legacy = append(c.legacy, files...)
+	return nil
+}
+
+// readLegacy reads a legacy file, returning an empty string if it
+// doesn't exist.
+func readLegacy(f File) (string, error) {
+	val, err := f.Read()
+	if xerrors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", xerrors.Errorf("read %s: %w", f, err)
+	}
+	return val, nil
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(ConfigDirEnv, dir)
+
+	files := map[string]string{
+		"session":                   "default-token",
+		"cloud_url":                 "https://cloud.example.com",
+		"profile":                   "work",
+		"profiles/work/session":     "work-token",
+		"profiles/work/cloud_url":   "https://work.example.com",
+		"profiles/empty/.keep":      "",
+		"profiles/-invalid/session": "invalid-token",
+		// Files an older agent didn't write, which must be kept.
+		"profiles/work/notes": "keep me",
+		"unrelated":           "keep me",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0750)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.CurrentProfile != "work" {
+		t.Fatalf("got current profile %q", c.CurrentProfile)
+	}
+	for p, want := range map[Profile]Settings{
+		DefaultProfile: {SessionToken: "default-token", CloudURL: "https://cloud.example.com"},
+		"work":         {SessionToken: "work-token", CloudURL: "https://work.example.com"},
+	} {
+		if got := c.Profile(p); got.SessionToken != want.SessionToken || got.CloudURL != want.CloudURL {
+			t.Fatalf("profile %q migrated as %+v", p, got)
+		}
+	}
+	for _, p := range []Profile{"empty", "-invalid"} {
+		if _, ok := c.Profiles[p]; ok {
+			t.Fatalf("profile %q migrated", p)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, string(ConfigFile))); err != nil {
+		t.Fatalf("migration wasn't saved: %v", err)
+	}
+	for name := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		switch name {
+		case "session", "cloud_url", "profile", "profiles/work/session", "profiles/work/cloud_url":
+			if !xerrors.Is(err, os.ErrNotExist) {
+				t.Errorf("migrated file %s wasn't removed: %v", name, err)
+			}
+		default:
+			if err != nil {
+				t.Errorf("file %s was removed: %v", name, err)
+			}
+		}
+	}
+
+	// Once migrated, the legacy files are ignored.
+	err = os.WriteFile(filepath.Join(dir, "session"), []byte("new-token"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := c.Profile(DefaultProfile).SessionToken; token != "default-token" {
+		t.Fatalf("legacy file migrated again: got token %q", token)
+	}
+}
+
+func TestMigrateEmptyProfileDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(ConfigDirEnv, dir)
+
+	err := os.MkdirAll(filepath.Join(dir, "profiles", "work"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "profiles", "work", "session"), []byte("token"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "profiles")); !xerrors.Is(err, os.ErrNotExist) {
+		t.Fatalf("emptied profiles directory wasn't removed: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"os"
+	"regexp"
+
+	"golang.org/x/xerrors"
+)
+
+// ProfileEnv is the environment variable selecting the active profile.
+const ProfileEnv = "CODER_CLOUD_PROFILE"
+
+// DefaultProfile is the profile used when none is selected.
+const DefaultProfile Profile = "default"
+
+var profileNameRx = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$")
+
+// Profile is the name of a set of settings, allowing the agent to hold
+// sessions for several Coder Cloud accounts or URLs at once.
+type Profile string
+
+// ValidateProfile returns an error if name can't be used as a
+// profile name.
+func ValidateProfile(name string) error {
+	if !profileNameRx.MatchString(name) {
+		return xerrors.Errorf("profile name must conform to regex %s", profileNameRx.String())
+	}
+	return nil
+}
+
+// ActiveProfile returns the profile selected by the environment or the
+// config's current profile, falling back to DefaultProfile.
+func (c *Config) ActiveProfile() (Profile, error) {
+	name := os.Getenv(ProfileEnv)
+	if name == "" {
+		name = string(c.CurrentProfile)
+	}
+	if name == "" {
+		return DefaultProfile, nil
+	}
+
+	err := ValidateProfile(name)
+	if err != nil {
+		return "", err
+	}
+	return Profile(name), nil
+}
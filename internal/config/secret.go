@@ -0,0 +1,265 @@
+package config
+
+import (
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// Secret backends selectable with SecretSettings.Backend.
+const (
+	// SecretBackendConfig stores secrets in the config document.
+	SecretBackendConfig = "config"
+	// SecretBackendKeyring stores secrets in the OS keyring through the
+	// Secret Service D-Bus API.
+	SecretBackendKeyring = "keyring"
+	// SecretBackendFile stores secrets in a file encrypted with a
+	// passphrase.
+	SecretBackendFile = "file"
+)
+
+// SecretsPassphraseEnv is the environment variable the encrypted file
+// backend reads its passphrase from if no other source is configured.
+const SecretsPassphraseEnv = "CODER_CLOUD_SECRETS_PASSPHRASE"
+
+// ErrSecretNotFound is returned by SecretStore.Get when the secret
+// doesn't exist.
+var ErrSecretNotFound = xerrors.New("secret not found")
+
+// SecretStore stores secrets such as session tokens outside of the
+// config document.
+type SecretStore interface {
+	// Get returns the secret stored under key, or ErrSecretNotFound.
+	Get(key string) (string, error)
+	// Set stores the secret under key, replacing any existing value.
+	Set(key, value string) error
+	// Delete removes the secret stored under key. Deleting a secret
+	// that doesn't exist is not an error.
+	Delete(key string) error
+}
+
+// SecretSettings select where secrets are stored.
+type SecretSettings struct {
+	// Backend is one of config, keyring or file.
+	Backend string `json:"backend,omitempty"`
+	// Passphrase is the passphrase used by the file backend. If it is
+	// empty, $CODER_CLOUD_SECRETS_PASSPHRASE is used.
+	Passphrase PasswordSource `json:"passphrase"`
+}
+
+// Validate returns an error if the settings are invalid.
+func (s SecretSettings) Validate() error {
+	switch s.Backend {
+	case "", SecretBackendConfig, SecretBackendKeyring, SecretBackendFile:
+	default:
+		return xerrors.Errorf("backend: unknown backend %q", s.Backend)
+	}
+	err := s.Passphrase.validate()
+	if err != nil {
+		return xerrors.Errorf("passphrase: %w", err)
+	}
+	return nil
+}
+
+// external reports whether secrets are stored outside of the config
+// document.
+func (s SecretSettings) external() bool {
+	return s.Backend != "" && s.Backend != SecretBackendConfig
+}
+
+// SecretStore returns the store selected by the config's secrets
+// backend. It returns nil if secrets are kept in the config document.
+func (c *Config) SecretStore() (SecretStore, error) {
+	if !c.Secrets.external() {
+		return nil, nil
+	}
+	if c.store != nil {
+		return c.store, nil
+	}
+
+	var (
+		store SecretStore
+		err   error
+	)
+	switch c.Secrets.Backend {
+	case SecretBackendKeyring:
+		store, err = OpenKeyring()
+	case SecretBackendFile:
+		src := c.Secrets.Passphrase
+		if src == (PasswordSource{}) {
+			src.Env = SecretsPassphraseEnv
+		}
+
+		var passphrase string
+		passphrase, err = src.Read()
+		if err == nil && passphrase == "" {
+			err = xerrors.New("no passphrase configured for the encrypted secrets file")
+		}
+		if err == nil {
+			store = NewEncryptedFile(SecretsFile, passphrase)
+		}
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("open %s secret store: %w", c.Secrets.Backend, err)
+	}
+
+	c.store = store
+	return store, nil
+}
+
+// SessionToken returns the profile's session token, or an empty string
+// if it isn't logged in. $CODER_CLOUD_SESSION_TOKEN takes precedence
+// over the stored token.
+func (c *Config) SessionToken(p Profile) (string, error) {
+	if token := os.Getenv(SessionTokenEnv); token != "" {
+		return token, nil
+	}
+	return c.storedSessionToken(p)
+}
+
+// SetSessionToken stores the profile's session token. An empty token
+// removes it. It must be called within Update.
+func (c *Config) SetSessionToken(p Profile, token string) error {
+	s := c.Profile(p)
+	if !c.Secrets.external() {
+		s.SessionToken = token
+		return nil
+	}
+
+	store, err := c.SecretStore()
+	if err != nil {
+		return err
+	}
+
+	if token == "" {
+		err = store.Delete(sessionTokenKey(p))
+	} else {
+		err = store.Set(sessionTokenKey(p), token)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Never leave a copy in the config document.
+	s.SessionToken = ""
+	return nil
+}
+
+// SetSecretBackend switches to another secrets backend, moving the
+// session tokens of every profile into it. The copies in the previous
+// store are deleted once the config document is saved. It must be
+// called within Update.
+func (c *Config) SetSecretBackend(backend string) error {
+	if backend == c.Secrets.Backend {
+		return nil
+	}
+	next := c.Secrets
+	next.Backend = backend
+	err := next.Validate()
+	if err != nil {
+		return err
+	}
+
+	tokens := make(map[Profile]string)
+	for p := range c.Profiles {
+		token, err := c.storedSessionToken(p)
+		if err != nil {
+			return xerrors.Errorf("read session token of profile %q: %w", p, err)
+		}
+		if token != "" {
+			tokens[p] = token
+		}
+	}
+	prev, err := c.SecretStore()
+	if err != nil {
+		return err
+	}
+
+	c.Secrets, c.store = next, nil
+	for p, token := range tokens {
+		err = c.SetSessionToken(p, token)
+		if err != nil {
+			return xerrors.Errorf("move session token of profile %q: %w", p, err)
+		}
+		if prev != nil {
+			c.stale = append(c.stale, staleSecret{store: prev, key: sessionTokenKey(p)})
+		}
+	}
+	return nil
+}
+
+// staleSecret is a secret left in a store that is no longer used.
+type staleSecret struct {
+	store SecretStore
+	key   string
+}
+
+// deleteStale deletes the secrets left behind by SetSecretBackend.
+func (c *Config) deleteStale() error {
+	for len(c.stale) > 0 {
+		err := c.stale[0].store.Delete(c.stale[0].key)
+		if err != nil {
+			return xerrors.Errorf("delete %s from previous secret store: %w", c.stale[0].key, err)
+		}
+		c.stale = c.stale[1:]
+	}
+	return nil
+}
+
+// storedSessionToken returns the profile's session token from the
+// config document or secret store, ignoring the environment.
+func (c *Config) storedSessionToken(p Profile) (string, error) {
+	s := c.Profile(p)
+	if s.SessionToken != "" || !c.Secrets.external() {
+		return s.SessionToken, nil
+	}
+
+	store, err := c.SecretStore()
+	if err != nil {
+		return "", err
+	}
+
+	token, err := store.Get(sessionTokenKey(p))
+	if xerrors.Is(err, ErrSecretNotFound) {
+		return "", nil
+	}
+	return token, err
+}
+
+// hasPlaintextSecrets reports whether session tokens are stored in the
+// config document even though an external secret store is selected.
+func (c *Config) hasPlaintextSecrets() bool {
+	if !c.Secrets.external() {
+		return false
+	}
+	for _, s := range c.Profiles {
+		if s != nil && s.SessionToken != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// moveSecrets moves session tokens stored in the config document into
+// the external secret store.
+func (c *Config) moveSecrets() error {
+	if !c.hasPlaintextSecrets() {
+		return nil
+	}
+
+	for p, s := range c.Profiles {
+		if s == nil || s.SessionToken == "" {
+			continue
+		}
+
+		err := c.SetSessionToken(p, s.SessionToken)
+		if err != nil {
+			return xerrors.Errorf("move session token of profile %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func sessionTokenKey(p Profile) string {
+	return "session_token/" + string(p)
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// SecretsFile is the file used by the encrypted file secret backend.
+	SecretsFile File = "secrets.enc"
+)
+
+// scrypt parameters recommended for interactive logins.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+)
+
+// encryptedSecrets is the on-disk format of the encrypted secrets file.
+type encryptedSecrets struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// EncryptedFile is a SecretStore that keeps all secrets in a single
+// file encrypted with AES-GCM, using a key derived from a passphrase
+// with scrypt. It is meant for machines without an OS keyring.
+type EncryptedFile struct {
+	file       File
+	passphrase string
+}
+
+var _ SecretStore = &EncryptedFile{}
+
+// NewEncryptedFile returns a store keeping secrets in file, encrypted
+// with passphrase.
+func NewEncryptedFile(file File, passphrase string) *EncryptedFile {
+	return &EncryptedFile{
+		file:       file,
+		passphrase: passphrase,
+	}
+}
+
+// Get implements SecretStore.
+func (f *EncryptedFile) Get(key string) (string, error) {
+	secrets, err := f.load()
+	if err != nil {
+		return "", err
+	}
+
+	val, ok := secrets[key]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return val, nil
+}
+
+// Set implements SecretStore.
+func (f *EncryptedFile) Set(key, value string) error {
+	unlock, err := lock(secretsLock)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	secrets, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	secrets[key] = value
+	return f.save(secrets)
+}
+
+// Delete implements SecretStore.
+func (f *EncryptedFile) Delete(key string) error {
+	unlock, err := lock(secretsLock)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	secrets, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[key]; !ok {
+		return nil
+	}
+
+	delete(secrets, key)
+	return f.save(secrets)
+}
+
+func (f *EncryptedFile) load() (map[string]string, error) {
+	b, err := read(string(f.file))
+	if xerrors.Is(err, os.ErrNotExist) {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("read %s: %w", f.file, err)
+	}
+
+	var enc encryptedSecrets
+	err = json.Unmarshal(b, &enc)
+	if err != nil {
+		return nil, xerrors.Errorf("parse %s: %w", f.file, err)
+	}
+
+	aead, err := f.aead(enc.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(enc.Nonce) != aead.NonceSize() {
+		return nil, xerrors.Errorf("parse %s: invalid nonce", f.file)
+	}
+
+	plain, err := aead.Open(nil, enc.Nonce, enc.Data, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("decrypt %s, is the passphrase correct?", f.file)
+	}
+
+	secrets := make(map[string]string)
+	err = json.Unmarshal(plain, &secrets)
+	if err != nil {
+		return nil, xerrors.Errorf("parse decrypted %s: %w", f.file, err)
+	}
+	return secrets, nil
+}
+
+func (f *EncryptedFile) save(secrets map[string]string) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return xerrors.Errorf("marshal secrets: %w", err)
+	}
+
+	// A fresh salt and nonce are used for every write.
+	enc := encryptedSecrets{
+		Salt: make([]byte, saltLen),
+	}
+	_, err = rand.Read(enc.Salt)
+	if err != nil {
+		return xerrors.Errorf("generate salt: %w", err)
+	}
+
+	aead, err := f.aead(enc.Salt)
+	if err != nil {
+		return err
+	}
+
+	enc.Nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(enc.Nonce)
+	if err != nil {
+		return xerrors.Errorf("generate nonce: %w", err)
+	}
+	enc.Data = aead.Seal(nil, enc.Nonce, plain, nil)
+
+	b, err := json.Marshal(enc)
+	if err != nil {
+		return xerrors.Errorf("marshal %s: %w", f.file, err)
+	}
+	return write(string(f.file), 0600, b)
+}
+
+func (f *EncryptedFile) aead(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(f.passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, xerrors.Errorf("derive key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
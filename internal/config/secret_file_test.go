@@ -0,0 +1,110 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedFile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// tamper modifies the encrypted file before it is read back.
+		tamper     func(enc *encryptedSecrets)
+		passphrase string
+		wantErr    string
+	}{
+		{
+			name:       "round trip",
+			passphrase: "correct horse",
+		},
+		{
+			name:       "wrong passphrase",
+			passphrase: "battery staple",
+			wantErr:    "is the passphrase correct?",
+		},
+		{
+			name:       "tampered ciphertext",
+			passphrase: "correct horse",
+			tamper:     func(enc *encryptedSecrets) { enc.Data[0] ^= 1 },
+			wantErr:    "is the passphrase correct?",
+		},
+		{
+			name:       "tampered salt",
+			passphrase: "correct horse",
+			tamper:     func(enc *encryptedSecrets) { enc.Salt[0] ^= 1 },
+			wantErr:    "is the passphrase correct?",
+		},
+		{
+			name:       "truncated nonce",
+			passphrase: "correct horse",
+			tamper:     func(enc *encryptedSecrets) { enc.Nonce = enc.Nonce[1:] },
+			wantErr:    "invalid nonce",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(ConfigDirEnv, t.TempDir())
+
+			err := NewEncryptedFile(SecretsFile, "correct horse").Set("session_token/default", "token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.tamper != nil {
+				b, err := read(string(SecretsFile))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var enc encryptedSecrets
+				err = json.Unmarshal(b, &enc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tc.tamper(&enc)
+				b, _ = json.Marshal(enc)
+				err = write(string(SecretsFile), 0600, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := NewEncryptedFile(SecretsFile, tc.passphrase).Get("session_token/default")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got %q, %v, want error %q", got, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "token" {
+				t.Fatalf("got secret %q, want %q", got, "token")
+			}
+		})
+	}
+}
+
+func TestEncryptedFileDelete(t *testing.T) {
+	t.Setenv(ConfigDirEnv, t.TempDir())
+	f := NewEncryptedFile(SecretsFile, "correct horse")
+
+	for _, key := range []string{"session_token/default", "session_token/work"} {
+		err := f.Set(key, "token")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := f.Delete("session_token/default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Get("session_token/default")
+	if err != ErrSecretNotFound {
+		t.Fatalf("got %v after delete, want ErrSecretNotFound", err)
+	}
+	err = expectSecret(f, "session_token/work", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/xerrors"
+)
+
+const (
+	secretService     = "org.freedesktop.secrets"
+	secretServicePath = dbus.ObjectPath("/org/freedesktop/secrets")
+	secretCollection  = dbus.ObjectPath("/org/freedesktop/secrets/aliases/default")
+	secretIface       = "org.freedesktop.Secret"
+
+	// keyringApplication is stored as an attribute of every item so
+	// the agent's secrets can be told apart from other applications'.
+	keyringApplication = "coder-cloud-agent"
+
+	// keyringPromptTimeout is how long the user has to answer an
+	// unlock prompt.
+	keyringPromptTimeout = 2 * time.Minute
+)
+
+// keyringSecret is the Secret struct defined by the Secret Service API.
+type keyringSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// Keyring is a SecretStore backed by the Secret Service D-Bus API, as
+// implemented by GNOME Keyring and KWallet. Secrets are stored in the
+// default collection.
+type Keyring struct {
+	conn    *dbus.Conn
+	session dbus.ObjectPath
+}
+
+var _ SecretStore = &Keyring{}
+
+// OpenKeyring connects to the Secret Service on the session bus.
+func OpenKeyring() (*Keyring, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, xerrors.Errorf("connect to session bus: %w", err)
+	}
+	return NewKeyring(conn)
+}
+
+// NewKeyring returns a Keyring talking to the Secret Service on conn.
+// It allows using a private bus, e.g. one serving a fake Secret Service.
+func NewKeyring(conn *dbus.Conn) (*Keyring, error) {
+	var (
+		out     dbus.Variant
+		session dbus.ObjectPath
+	)
+	err := conn.Object(secretService, secretServicePath).
+		Call(secretIface+".Service.OpenSession", 0, "plain", dbus.MakeVariant("")).
+		Store(&out, &session)
+	if err != nil {
+		return nil, xerrors.Errorf("open secret service session: %w", err)
+	}
+
+	return &Keyring{
+		conn:    conn,
+		session: session,
+	}, nil
+}
+
+// Get implements SecretStore.
+func (k *Keyring) Get(key string) (string, error) {
+	items, err := k.search(key)
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "", ErrSecretNotFound
+	}
+
+	var secret keyringSecret
+	err = k.conn.Object(secretService, items[0]).
+		Call(secretIface+".Item.GetSecret", 0, k.session).
+		Store(&secret)
+	if err != nil {
+		return "", xerrors.Errorf("get secret: %w", err)
+	}
+
+	return string(secret.Value), nil
+}
+
+// Set implements SecretStore.
+func (k *Keyring) Set(key, value string) error {
+	err := k.unlock([]dbus.ObjectPath{secretCollection})
+	if err != nil {
+		return err
+	}
+
+	props := map[string]dbus.Variant{
+		secretIface + ".Item.Label":      dbus.MakeVariant("Coder Cloud Agent " + key),
+		secretIface + ".Item.Attributes": dbus.MakeVariant(keyringAttributes(key)),
+	}
+	secret := keyringSecret{
+		Session:     k.session,
+		Parameters:  []byte{},
+		Value:       []byte(value),
+		ContentType: "text/plain",
+	}
+
+	var item, prompt dbus.ObjectPath
+	err = k.conn.Object(secretService, secretCollection).
+		Call(secretIface+".Collection.CreateItem", 0, props, secret, true).
+		Store(&item, &prompt)
+	if err != nil {
+		return xerrors.Errorf("create item: %w", err)
+	}
+
+	return k.prompt(prompt)
+}
+
+// Delete implements SecretStore.
+func (k *Keyring) Delete(key string) error {
+	items, err := k.search(key)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		var prompt dbus.ObjectPath
+		err = k.conn.Object(secretService, item).
+			Call(secretIface+".Item.Delete", 0).
+			Store(&prompt)
+		if err != nil {
+			return xerrors.Errorf("delete item: %w", err)
+		}
+
+		err = k.prompt(prompt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// search returns the unlocked items holding key, unlocking them if
+// necessary.
+func (k *Keyring) search(key string) ([]dbus.ObjectPath, error) {
+	var unlocked, locked []dbus.ObjectPath
+	err := k.conn.Object(secretService, secretServicePath).
+		Call(secretIface+".Service.SearchItems", 0, keyringAttributes(key)).
+		Store(&unlocked, &locked)
+	if err != nil {
+		return nil, xerrors.Errorf("search items: %w", err)
+	}
+
+	if len(locked) > 0 {
+		err = k.unlock(locked)
+		if err != nil {
+			return nil, err
+		}
+		unlocked = append(unlocked, locked...)
+	}
+
+	return unlocked, nil
+}
+
+func (k *Keyring) unlock(objects []dbus.ObjectPath) error {
+	var (
+		unlocked []dbus.ObjectPath
+		prompt   dbus.ObjectPath
+	)
+	err := k.conn.Object(secretService, secretServicePath).
+		Call(secretIface+".Service.Unlock", 0, objects).
+		Store(&unlocked, &prompt)
+	if err != nil {
+		return xerrors.Errorf("unlock: %w", err)
+	}
+
+	return k.prompt(prompt)
+}
+
+// prompt shows the prompt at path, if any, and waits for the user to
+// complete it.
+func (k *Keyring) prompt(path dbus.ObjectPath) error {
+	if path == "/" || path == "" {
+		return nil
+	}
+
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(path),
+		dbus.WithMatchInterface(secretIface + ".Prompt"),
+		dbus.WithMatchMember("Completed"),
+	}
+	err := k.conn.AddMatchSignal(match...)
+	if err != nil {
+		return xerrors.Errorf("watch prompt: %w", err)
+	}
+	defer k.conn.RemoveMatchSignal(match...) //nolint:errcheck
+
+	signals := make(chan *dbus.Signal, 1)
+	k.conn.Signal(signals)
+	defer k.conn.RemoveSignal(signals)
+
+	err = k.conn.Object(secretService, path).Call(secretIface+".Prompt.Prompt", 0, "").Err
+	if err != nil {
+		return xerrors.Errorf("prompt: %w", err)
+	}
+
+	timeout := time.NewTimer(keyringPromptTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case sig := <-signals:
+			if sig.Path != path || sig.Name != secretIface+".Prompt.Completed" {
+				continue
+			}
+			if len(sig.Body) > 0 {
+				if dismissed, _ := sig.Body[0].(bool); dismissed {
+					return xerrors.New("keyring prompt dismissed")
+				}
+			}
+			return nil
+		case <-timeout.C:
+			return xerrors.New("timed out waiting for keyring prompt")
+		}
+	}
+}
+
+func keyringAttributes(key string) map[string]string {
+	return map[string]string{
+		"application": keyringApplication,
+		"key":         key,
+	}
+}
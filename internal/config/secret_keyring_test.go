@@ -0,0 +1,373 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/xerrors"
+)
+
+const busConfig = `<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// privateBus starts a D-Bus daemon for the test and returns its address.
+// The test is skipped if dbus-daemon isn't installed.
+func privateBus(t *testing.T) string {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not installed")
+	}
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "bus.conf")
+	err = os.WriteFile(conf, []byte(fmt.Sprintf(busConfig, dir)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+conf, "--print-address", "--nofork")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	addr, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read bus address: %v", err)
+	}
+	return strings.TrimSpace(addr)
+}
+
+// fakeSecretService implements the parts of the Secret Service API used
+// by Keyring, keeping secrets in memory. Items can be locked, in which
+// case unlocking them goes through a prompt that is dismissed if dismiss
+// is set.
+type fakeSecretService struct {
+	conn *dbus.Conn
+
+	mu      sync.Mutex
+	items   map[dbus.ObjectPath]*fakeItem
+	next    int
+	locked  bool
+	dismiss bool
+	prompts int
+}
+
+type fakeItem struct {
+	svc   *fakeSecretService
+	path  dbus.ObjectPath
+	attrs map[string]string
+	value []byte
+}
+
+// newFakeSecretService exports a fake Secret Service on a private bus and
+// returns it along with a connection to the bus for the Keyring.
+func newFakeSecretService(t *testing.T) (*fakeSecretService, *dbus.Conn) {
+	addr := privateBus(t)
+
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	svc := &fakeSecretService{
+		conn:  conn,
+		items: make(map[dbus.ObjectPath]*fakeItem),
+	}
+	err = conn.Export(fakeService{svc}, secretServicePath, secretIface+".Service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Export(fakeCollection{svc}, secretCollection, secretIface+".Collection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := conn.RequestName(secretService, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("own %s: %v, %v", secretService, reply, err)
+	}
+
+	client, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return svc, client
+}
+
+// prompt exports a prompt completing the pending operation.
+func (s *fakeSecretService) prompt() dbus.ObjectPath {
+	s.next++
+	path := dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/secrets/prompt/p%d", s.next))
+	_ = s.conn.Export(fakePrompt{s, path}, path, secretIface+".Prompt")
+	return path
+}
+
+type fakeService struct{ *fakeSecretService }
+
+func (s fakeService) OpenSession(algorithm string, _ dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	if algorithm != "plain" {
+		return dbus.Variant{}, "", dbus.MakeFailedError(xerrors.Errorf("unsupported algorithm %q", algorithm))
+	}
+	return dbus.MakeVariant(""), "/org/freedesktop/secrets/session/s1", nil
+}
+
+func (s fakeService) SearchItems(attrs map[string]string) (unlocked, locked []dbus.ObjectPath, _ *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlocked, locked = []dbus.ObjectPath{}, []dbus.ObjectPath{}
+	for path, item := range s.items {
+		if !item.matches(attrs) {
+			continue
+		}
+		if s.locked {
+			locked = append(locked, path)
+		} else {
+			unlocked = append(unlocked, path)
+		}
+	}
+	return unlocked, locked, nil
+}
+
+func (s fakeService) Unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.locked {
+		return objects, "/", nil
+	}
+	return []dbus.ObjectPath{}, s.prompt(), nil
+}
+
+type fakeCollection struct{ *fakeSecretService }
+
+func (c fakeCollection) CreateItem(props map[string]dbus.Variant, secret keyringSecret, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	var attrs map[string]string
+	err := props[secretIface+".Item.Attributes"].Store(&attrs)
+	if err != nil {
+		return "", "", dbus.MakeFailedError(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.locked {
+		return "", "", dbus.MakeFailedError(xerrors.New("collection is locked"))
+	}
+	if replace {
+		for path, item := range c.items {
+			if item.matches(attrs) && len(item.attrs) == len(attrs) {
+				item.value = secret.Value
+				return path, "/", nil
+			}
+		}
+	}
+
+	c.next++
+	item := &fakeItem{
+		svc:   c.fakeSecretService,
+		path:  dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/secrets/collection/login/%d", c.next)),
+		attrs: attrs,
+		value: secret.Value,
+	}
+	c.items[item.path] = item
+	_ = c.conn.Export(item, item.path, secretIface+".Item")
+	return item.path, "/", nil
+}
+
+func (i *fakeItem) matches(attrs map[string]string) bool {
+	for k, v := range attrs {
+		if i.attrs[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *fakeItem) GetSecret(session dbus.ObjectPath) (keyringSecret, *dbus.Error) {
+	i.svc.mu.Lock()
+	defer i.svc.mu.Unlock()
+
+	if i.svc.locked {
+		return keyringSecret{}, dbus.NewError(secretIface+".Error.IsLocked", nil)
+	}
+	return keyringSecret{
+		Session:     session,
+		Parameters:  []byte{},
+		Value:       i.value,
+		ContentType: "text/plain",
+	}, nil
+}
+
+func (i *fakeItem) Delete() (dbus.ObjectPath, *dbus.Error) {
+	i.svc.mu.Lock()
+	defer i.svc.mu.Unlock()
+
+	delete(i.svc.items, i.path)
+	_ = i.svc.conn.Export(nil, i.path, secretIface+".Item")
+	return "/", nil
+}
+
+type fakePrompt struct {
+	*fakeSecretService
+	path dbus.ObjectPath
+}
+
+func (p fakePrompt) Prompt(string) *dbus.Error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prompts++
+	dismissed := p.dismiss
+	if !dismissed {
+		p.locked = false
+	}
+	// The outcome is signaled once the user answers, after Prompt
+	// returns.
+	go func() {
+		_ = p.conn.Emit(p.path, secretIface+".Prompt.Completed", dismissed, dbus.MakeVariant(""))
+	}()
+	return nil
+}
+
+func TestKeyring(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// locked locks the keyring after the secret is stored.
+		locked  bool
+		dismiss bool
+		// run gets, sets and deletes secrets, returning the error to
+		// check against wantErr.
+		run     func(k *Keyring) error
+		wantErr string
+		prompts int
+	}{
+		{
+			name: "round trip",
+			run: func(k *Keyring) error {
+				return expectSecret(k, "session_token/default", "token")
+			},
+		},
+		{
+			name: "replace",
+			run: func(k *Keyring) error {
+				err := k.Set("session_token/default", "new")
+				if err != nil {
+					return err
+				}
+				return expectSecret(k, "session_token/default", "new")
+			},
+		},
+		{
+			name: "not found",
+			run: func(k *Keyring) error {
+				_, err := k.Get("session_token/other")
+				return err
+			},
+			wantErr: ErrSecretNotFound.Error(),
+		},
+		{
+			name: "delete",
+			run: func(k *Keyring) error {
+				err := k.Delete("session_token/default")
+				if err != nil {
+					return err
+				}
+				err = k.Delete("session_token/default")
+				if err != nil {
+					return xerrors.Errorf("delete missing secret: %w", err)
+				}
+				_, err = k.Get("session_token/default")
+				return err
+			},
+			wantErr: ErrSecretNotFound.Error(),
+		},
+		{
+			name:   "unlock",
+			locked: true,
+			run: func(k *Keyring) error {
+				return expectSecret(k, "session_token/default", "token")
+			},
+			prompts: 1,
+		},
+		{
+			name:    "prompt dismissed",
+			locked:  true,
+			dismiss: true,
+			run: func(k *Keyring) error {
+				_, err := k.Get("session_token/default")
+				return err
+			},
+			wantErr: "keyring prompt dismissed",
+			prompts: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, conn := newFakeSecretService(t)
+			k, err := NewKeyring(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = k.Set("session_token/default", "token")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			svc.mu.Lock()
+			svc.locked, svc.dismiss = tc.locked, tc.dismiss
+			svc.mu.Unlock()
+
+			err = tc.run(k)
+			if tc.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+
+			svc.mu.Lock()
+			defer svc.mu.Unlock()
+			if svc.prompts != tc.prompts {
+				t.Fatalf("got %d prompts, want %d", svc.prompts, tc.prompts)
+			}
+		})
+	}
+}
+
+// expectSecret returns an error unless store holds want under key.
+func expectSecret(store SecretStore, key, want string) error {
+	got, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return xerrors.Errorf("got secret %q, want %q", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"testing"
+)
+
+// memStore is a SecretStore kept in memory.
+type memStore map[string]string
+
+func (m memStore) Get(key string) (string, error) {
+	v, ok := m[key]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return v, nil
+}
+
+func (m memStore) Set(key, value string) error {
+	m[key] = value
+	return nil
+}
+
+func (m memStore) Delete(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func TestSetSecretBackend(t *testing.T) {
+	t.Setenv(SessionTokenEnv, "")
+	t.Setenv(SecretsPassphraseEnv, "correct horse")
+
+	for _, tc := range []struct {
+		name     string
+		from, to string
+	}{
+		{name: "config to file", from: SecretBackendConfig, to: SecretBackendFile},
+		{name: "file to config", from: SecretBackendFile, to: SecretBackendConfig},
+		{name: "keyring to config", from: SecretBackendKeyring, to: SecretBackendConfig},
+		{name: "keyring to file", from: SecretBackendKeyring, to: SecretBackendFile},
+		{name: "unset", from: SecretBackendFile, to: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(ConfigDirEnv, t.TempDir())
+			// The keyring is replaced by a store in memory.
+			keyring := memStore{}
+			update := func(fn func(c *Config) error) *Config {
+				t.Helper()
+				c, err := Update(func(c *Config) error {
+					if c.Secrets.Backend == SecretBackendKeyring {
+						c.store = keyring
+					}
+					return fn(c)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return c
+			}
+
+			update(func(c *Config) error {
+				c.Secrets.Backend = tc.from
+				if tc.from == SecretBackendKeyring {
+					c.store = keyring
+				}
+				for _, p := range []Profile{DefaultProfile, "work"} {
+					err := c.SetSessionToken(p, "token-"+string(p))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			prev := update(func(*Config) error { return nil })
+			prevStore, err := prev.SecretStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := update(func(c *Config) error {
+				return c.Set(DefaultProfile, "secrets.backend", tc.to)
+			})
+			if c.Secrets.Backend != tc.to {
+				t.Fatalf("got backend %q, want %q", c.Secrets.Backend, tc.to)
+			}
+
+			for _, p := range []Profile{DefaultProfile, "work"} {
+				token, err := c.SessionToken(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if token != "token-"+string(p) {
+					t.Fatalf("profile %q has token %q after switching", p, token)
+				}
+				if c.Secrets.external() && c.Profile(p).SessionToken != "" {
+					t.Fatalf("profile %q token left in the config document", p)
+				}
+				if prevStore != nil {
+					_, err = prevStore.Get(sessionTokenKey(p))
+					if err != ErrSecretNotFound {
+						t.Fatalf("profile %q token left in the previous store: %v", p, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSetSecretBackendInvalid(t *testing.T) {
+	t.Setenv(ConfigDirEnv, t.TempDir())
+
+	_, err := Update(func(c *Config) error {
+		c.Profile(DefaultProfile).SessionToken = "token"
+		return c.Set(DefaultProfile, "secrets.backend", "vault")
+	})
+	if err == nil {
+		t.Fatal("unknown backend accepted")
+	}
+}
@@ -0,0 +1,238 @@
+package ideproxy
+
+import (
+	"context"
+	"html/template"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"cdr.dev/slog"
+	"golang.org/x/xerrors"
+)
+
+// Ways of checking that code-server is up.
+const (
+	// CheckHTTP requests code-server's /healthz endpoint.
+	CheckHTTP = "http"
+	// CheckTCP only dials code-server.
+	CheckTCP = "tcp"
+)
+
+const (
+	defaultHealthInterval = 5 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	// maxWaitInterval caps how often Wait probes, so a code-server that
+	// is starting up is noticed quickly.
+	maxWaitInterval = 500 * time.Millisecond
+)
+
+// healthClient probes code-server. It ignores proxy settings as
+// code-server is usually local, and doesn't follow redirects to the
+// login page.
+var healthClient = &http.Client{
+	Transport: &http.Transport{
+		DisableKeepAlives: true,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Upstream monitors whether code-server is up.
+type Upstream struct {
+	Log  slog.Logger
+	Addr string
+	// Check is CheckHTTP or CheckTCP. CheckHTTP is used if it is empty.
+	Check string
+	// Interval is how often code-server is checked. It defaults to 5s.
+	Interval time.Duration
+	// Timeout bounds a single check. It defaults to 2s.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	status  UpstreamStatus
+	changed chan struct{}
+}
+
+// UpstreamStatus is the outcome of the latest check of code-server.
+type UpstreamStatus struct {
+	// Checked is false until code-server is checked for the first time.
+	Checked bool
+	Up      bool
+	// Err is why code-server is down.
+	Err error
+	// Since is when code-server went up or down.
+	Since time.Time
+}
+
+// Status returns the status of code-server and a channel that is closed
+// once code-server goes up or down.
+func (u *Upstream) Status() (UpstreamStatus, <-chan struct{}) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.changed == nil {
+		u.changed = make(chan struct{})
+	}
+	return u.status, u.changed
+}
+
+// Probe checks once whether code-server is up and records the outcome.
+func (u *Upstream) Probe(ctx context.Context) error {
+	err := u.check(ctx)
+	if ctx.Err() != nil {
+		// The check was interrupted, which says nothing about
+		// code-server.
+		return ctx.Err()
+	}
+	u.set(err)
+	return err
+}
+
+// Wait probes code-server until it is up or ctx is canceled.
+func (u *Upstream) Wait(ctx context.Context) error {
+	interval := u.interval()
+	if interval > maxWaitInterval {
+		interval = maxWaitInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := u.Probe(ctx)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			status, _ := u.Status()
+			if status.Err != nil {
+				return status.Err
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run probes code-server every Interval until ctx is canceled.
+func (u *Upstream) Run(ctx context.Context) {
+	ticker := time.NewTicker(u.interval())
+	defer ticker.Stop()
+
+	for {
+		_ = u.Probe(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *Upstream) check(ctx context.Context) error {
+	timeout := u.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if u.Check == CheckTCP {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", u.Addr)
+		if err != nil {
+			return xerrors.Errorf("dial code-server: %w", err)
+		}
+		conn.Close()
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+u.Addr+"/healthz", nil)
+	if err != nil {
+		return xerrors.Errorf("new request: %w", err)
+	}
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return xerrors.Errorf("request code-server health: %w", err)
+	}
+	resp.Body.Close()
+
+	// Releases of code-server without the endpoint respond with a 404
+	// or a redirect, which still shows it is serving.
+	if resp.StatusCode >= 500 {
+		return xerrors.Errorf("code-server health: %s", resp.Status)
+	}
+	return nil
+}
+
+// set records the outcome of a check, logging and announcing code-server
+// going up or down.
+func (u *Upstream) set(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	up := err == nil
+	transition := !u.status.Checked || u.status.Up != up
+	u.status.Err = err
+	if !transition {
+		return
+	}
+
+	u.status.Checked = true
+	u.status.Up = up
+	u.status.Since = time.Now()
+	if up {
+		u.Log.Info(context.Background(), "code-server is up", slog.F("addr", u.Addr))
+	} else {
+		u.Log.Warn(context.Background(), "code-server is down", slog.F("addr", u.Addr), slog.Error(err))
+	}
+
+	if u.changed != nil {
+		close(u.changed)
+	}
+	u.changed = make(chan struct{})
+}
+
+func (u *Upstream) interval() time.Duration {
+	if u.Interval <= 0 {
+		return defaultHealthInterval
+	}
+	return u.Interval
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>code-server is unavailable</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; color: #333; }
+code { background: #eee; padding: 0.1em 0.3em; }
+</style>
+</head>
+<body>
+<h1>code-server is unavailable</h1>
+<p>The agent is connected, but it can't reach code-server at <code>{{.Addr}}</code>.</p>
+<p><code>{{.Err}}</code></p>
+<p>Make sure code-server is running on the machine. This page reloads automatically.</p>
+</body>
+</html>
+`))
+
+// serveStatusPage explains that code-server couldn't be reached.
+func serveStatusPage(w http.ResponseWriter, addr string, err error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "5")
+	w.WriteHeader(http.StatusBadGateway)
+	_ = statusPage.Execute(w, struct {
+		Addr string
+		Err  error
+	}{addr, err})
+}
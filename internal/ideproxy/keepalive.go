@@ -0,0 +1,92 @@
+package ideproxy
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"cdr.dev/slog"
+	"github.com/hashicorp/yamux"
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+)
+
+// Keepalive configures how the agent detects that its connection to
+// Coder Cloud died, e.g. because a network change left it half-open.
+// Zero fields take yamux's defaults.
+type Keepalive struct {
+	// Interval is how often yamux pings Coder Cloud over the tunnel.
+	Interval time.Duration
+	// WriteTimeout is how long a write to the tunnel, including a
+	// yamux ping, may block before the connection is considered dead.
+	WriteTimeout time.Duration
+	// WindowSize is the maximum receive window of a stream in bytes.
+	WindowSize uint32
+	// PingInterval is how often the websocket is pinged. Websocket
+	// pings are disabled if it is zero.
+	PingInterval time.Duration
+	// PingTimeout is how long to wait for a websocket pong. It
+	// defaults to PingInterval.
+	PingTimeout time.Duration
+}
+
+// ErrPingTimeout is returned by Proxy when Coder Cloud stopped answering
+// websocket pings.
+var ErrPingTimeout = xerrors.New("websocket ping timed out")
+
+// yamuxConfig returns the configuration of the tunnel's multiplexer.
+func (k Keepalive) yamuxConfig() *yamux.Config {
+	conf := yamux.DefaultConfig()
+	if k.Interval > 0 {
+		conf.KeepAliveInterval = k.Interval
+	}
+	if k.WriteTimeout > 0 {
+		conf.ConnectionWriteTimeout = k.WriteTimeout
+	}
+	if k.WindowSize > 0 {
+		conf.MaxStreamWindowSize = k.WindowSize
+	}
+	return conf
+}
+
+// ping pings the websocket every PingInterval until ctx is canceled. If
+// a pong doesn't arrive within PingTimeout, conn is closed so the tunnel
+// fails promptly instead of hanging on a dead peer, and ErrPingTimeout
+// is sent on failed.
+//
+// A ping only completes while the websocket is being read from.
+func (k Keepalive) ping(ctx context.Context, log slog.Logger, ws *websocket.Conn, conn io.Closer, failed chan<- error) {
+	if k.PingInterval <= 0 {
+		return
+	}
+	timeout := k.PingTimeout
+	if timeout <= 0 {
+		timeout = k.PingInterval
+	}
+
+	ticker := time.NewTicker(k.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pctx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		err := ws.Ping(pctx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warn(ctx, "websocket ping failed, closing connection", slog.Error(err))
+			failed <- xerrors.Errorf("%w: %v", ErrPingTimeout, err)
+			_ = conn.Close()
+			return
+		}
+		log.Debug(ctx, "websocket pong", slog.F("rtt", time.Since(start)))
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"time"
 
 	"cdr.dev/slog"
 	"github.com/hashicorp/yamux"
@@ -27,9 +29,27 @@ type Agent struct {
 	CodeServerAddr     string
 	CodeServerPassword string
 	CloudProxyURL      string
+	// HTTPClient is used to connect to Coder Cloud.
+	// http.DefaultClient is used if it is nil.
+	HTTPClient *http.Client
+	// DrainTimeout is how long active streams are given to finish once
+	// the context passed to Proxy is canceled. Streams are closed
+	// immediately if it is zero.
+	DrainTimeout time.Duration
+	// Keepalive configures how a dead connection to Coder Cloud is
+	// detected.
+	Keepalive Keepalive
 }
 
-// Proxy proxies a Coder Cloud connection to a local code server instance.
+// ErrDrainTimeout is returned by Proxy when streams were still active
+// after DrainTimeout and had to be closed.
+var ErrDrainTimeout = xerrors.New("timed out draining streams")
+
+// Proxy proxies a Coder Cloud connection to a local code server
+// instance until the connection closes or ctx is canceled. Once ctx is
+// canceled, no new streams are accepted and active streams are given
+// DrainTimeout to finish before the connection is closed normally. Proxy
+// returns nil after a clean shutdown.
 func (a *Agent) Proxy(ctx context.Context) error {
 	l, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -42,15 +62,35 @@ func (a *Agent) Proxy(ctx context.Context) error {
 		return xerrors.Errorf("invalid cloud URL: %w", err)
 	}
 
+	srv := &http.Server{
+		Handler: codeServerReverseProxy(a.Log, a.CodeServerAddr, a.CodeServerPassword),
+	}
 	go func() {
-		err := http.Serve(l,
-			codeServerReverseProxy(a.CodeServerAddr, a.CodeServerPassword))
-		a.Log.Warn(ctx, "code-server proxy exited", slog.Error(err))
+		err := srv.Serve(l)
+		if !xerrors.Is(err, http.ErrServerClosed) {
+			a.Log.Warn(ctx, "code-server proxy exited", slog.Error(err))
+		}
+	}()
+
+	// Once ctx is canceled, let in-flight requests finish and close idle
+	// keep-alive connections so their streams can drain.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+			_ = srv.Close()
+		case <-ctx.Done():
+			sctx, cancel := context.WithTimeout(context.Background(), a.DrainTimeout)
+			defer cancel()
+			_ = srv.Shutdown(sctx)
+		}
 	}()
 
 	client := &client.Client{
-		BaseURL: baseURL,
-		Token:   a.SessionToken,
+		BaseURL:    baseURL,
+		Token:      a.SessionToken,
+		HTTPClient: a.HTTPClient,
 	}
 
 	ws, err := client.ProxyAgent(ctx, a.CodeServerID)
@@ -58,41 +98,147 @@ func (a *Agent) Proxy(ctx context.Context) error {
 		return xerrors.Errorf("proxy agent: %w", err)
 	}
 
-	conn := websocket.NetConn(ctx, ws, websocket.MessageBinary)
+	// The connection must outlive ctx while streams drain.
+	connCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Closing conn closes the websocket normally, telling Coder Cloud
+	// the agent went away on purpose.
+	conn := websocket.NetConn(connCtx, ws, websocket.MessageBinary)
+	defer conn.Close()
 
-	err = proxyCodeServer(ctx, a.Log, conn, l.Addr().String())
+	pingFailed := make(chan error, 1)
+	go a.Keepalive.ping(connCtx, a.Log, ws, conn, pingFailed)
+
+	err = a.proxyCodeServer(ctx, conn, l.Addr().String())
+	select {
+	case err := <-pingFailed:
+		return err
+	default:
+	}
+	if xerrors.Is(err, ErrDrainTimeout) {
+		return err
+	}
 	if err != nil && !xerrors.Is(err, io.EOF) {
 		return xerrors.Errorf("proxy code-server: %w", err)
 	}
 	return nil
 }
 
-// proxyCodeServer proxies a Coder Cloud connection to the local code-server.
-func proxyCodeServer(ctx context.Context, log slog.Logger, proxyConn net.Conn, addr string) error {
-	stream, err := yamux.Server(proxyConn, nil)
+// Retryable reports whether a Proxy error may go away by connecting
+// again. Errors caused by a rejected session token, a deleted server or
+// any other client error besides timeouts and rate limiting are
+// permanent.
+func Retryable(err error) bool {
+	switch code := client.StatusCode(err); {
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return true
+	case code >= 400 && code < 500:
+		return false
+	}
+	return true
+}
+
+// proxyCodeServer proxies a Coder Cloud connection to the local
+// code-server until the connection closes or ctx is canceled, after
+// which active streams are drained.
+func (a *Agent) proxyCodeServer(ctx context.Context, proxyConn net.Conn, addr string) error {
+	log := a.Log
+	session, err := yamux.Server(proxyConn, a.Keepalive.yamuxConfig())
 	if err != nil {
 		return xerrors.Errorf("multiplex stream: %w", err)
 	}
+	defer session.Close()
 
-	for {
-		conn, err := stream.Accept()
-		if err != nil {
-			return xerrors.Errorf("accept stream: %w", err)
-		}
+	// Streams are only closed early if they outlive the drain.
+	streamCtx, closeStreams := context.WithCancel(context.Background())
+	defer closeStreams()
 
-		go func() {
-			csConn, err := net.Dial("tcp", addr)
+	var (
+		mu       sync.Mutex
+		draining bool
+		active   sync.WaitGroup
+	)
+	acceptErr := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := session.Accept()
 			if err != nil {
-				log.Error(ctx, "dial code-server", slog.Error(err))
+				acceptErr <- xerrors.Errorf("accept stream: %w", err)
 				return
 			}
-			// Bicopy closes the streams.
-			bicopy(ctx, csConn, conn)
-		}()
+
+			mu.Lock()
+			if draining {
+				mu.Unlock()
+				conn.Close()
+				continue
+			}
+			active.Add(1)
+			mu.Unlock()
+
+			go func() {
+				defer active.Done()
+
+				csConn, err := net.Dial("tcp", addr)
+				if err != nil {
+					log.Error(ctx, "dial code-server", slog.Error(err))
+					conn.Close()
+					return
+				}
+				// Bicopy closes the streams.
+				bicopy(streamCtx, csConn, conn)
+			}()
+		}
+	}()
+
+	select {
+	case err := <-acceptErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Ask Coder Cloud to stop opening streams and give the active ones
+	// time to finish.
+	_ = session.GoAway()
+	mu.Lock()
+	draining = true
+	mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		active.Wait()
+		close(drained)
+	}()
+
+	if a.DrainTimeout <= 0 {
+		// Closing streams right away is what was asked for, so it
+		// isn't a timeout.
+		closeStreams()
+		<-drained
+		return nil
+	}
+
+	log.Info(ctx, "draining streams", slog.F("timeout", a.DrainTimeout), slog.F("active", session.NumStreams()))
+	timer := time.NewTimer(a.DrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		return nil
+	case err := <-acceptErr:
+		// The connection closed while draining, taking the streams
+		// with it.
+		closeStreams()
+		<-drained
+		return err
+	case <-timer.C:
+		closeStreams()
+		<-drained
+		return ErrDrainTimeout
 	}
 }
 
-func codeServerReverseProxy(addr, password string) http.Handler {
+func codeServerReverseProxy(log slog.Logger, addr, password string) http.Handler {
 	rp := httputil.NewSingleHostReverseProxy(&url.URL{
 		Scheme: "http",
 		Host:   addr,
@@ -108,6 +254,14 @@ func codeServerReverseProxy(addr, password string) http.Handler {
 		}
 		dir(r)
 	}
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if r.Context().Err() != nil {
+			// The IDE went away, there's nobody to tell.
+			return
+		}
+		log.Warn(r.Context(), "proxy request to code-server", slog.F("path", r.URL.Path), slog.Error(err))
+		serveStatusPage(w, addr, err)
+	}
 
 	return rp
 }
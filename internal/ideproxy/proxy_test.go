@@ -0,0 +1,562 @@
+package ideproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"go.uber.org/goleak"
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+
+	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/cloud-agent/pkg/cloudtest"
+)
+
+const password = "hunter2"
+
+// newCodeServer starts a fake code-server. / echoes the request path and
+// the password cookie, /ws echoes websocket messages, /upload responds
+// with the size and hash of the body and /slow responds once release is
+// closed, announcing every request on arrived.
+func newCodeServer(t *testing.T, release <-chan struct{}, arrived chan<- struct{}) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		key, _ := r.Cookie("key")
+		if key != nil {
+			w.Header().Set("X-Key", key.Value)
+		}
+		fmt.Fprint(w, r.URL.RequestURI())
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusInternalError, "")
+
+		for {
+			typ, msg, err := conn.Read(r.Context())
+			if err != nil {
+				return
+			}
+			err = conn.Write(r.Context(), typ, msg)
+			if err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+		select {
+		case <-release:
+			fmt.Fprint(w, "done")
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		h := sha256.New()
+		n, err := io.Copy(h, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d %x", n, h.Sum(nil))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+type env struct {
+	cloud      *cloudtest.Server
+	codeServer *httptest.Server
+	id         string
+	ide        *http.Client
+	// release releases the requests to /slow.
+	release chan struct{}
+	// arrived receives a value whenever a request reaches /slow.
+	arrived chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// exited receives the result of every Agent.Proxy call.
+	exited chan error
+	done   chan struct{}
+}
+
+// setup starts a fake cloud and code-server and an agent proxying
+// between them. The agent reconnects whenever its connection closes
+// until the test ends, after which no goroutines may be left running.
+func setup(t *testing.T, opts ...func(*Agent)) *env {
+	// Cleanups run last to first, so this runs once everything else
+	// shut down.
+	t.Cleanup(func() { goleak.VerifyNone(t) })
+
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 16)
+	codeServer := newCodeServer(t, release, arrived)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	cloud := cloudtest.New()
+	t.Cleanup(cloud.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	cli := &client.Client{Token: cloudtest.Session, BaseURL: cloud.BaseURL()}
+	cs, err := cli.RegisterCodeServer(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent := &Agent{
+		Log:                slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}),
+		CodeServerID:       cs.ID,
+		SessionToken:       cloudtest.Session,
+		CodeServerAddr:     strings.TrimPrefix(codeServer.URL, "http://"),
+		CodeServerPassword: password,
+		CloudProxyURL:      cloud.URL,
+	}
+	for _, opt := range opts {
+		opt(agent)
+	}
+
+	e := &env{
+		cloud:      cloud,
+		codeServer: codeServer,
+		id:         cs.ID,
+		ide:        cloud.IDEClient(cs.ID),
+		release:    release,
+		arrived:    arrived,
+		ctx:        ctx,
+		cancel:     cancel,
+		exited:     make(chan error, 16),
+		done:       make(chan struct{}),
+	}
+	t.Cleanup(e.ide.CloseIdleConnections)
+
+	go func() {
+		defer close(e.done)
+		for ctx.Err() == nil {
+			err := agent.Proxy(ctx)
+			select {
+			case e.exited <- err:
+			default:
+			}
+		}
+	}()
+	// Stop the agent before the cloud and code-server shut down.
+	t.Cleanup(e.stop)
+
+	e.waitTunnel(t)
+	return e
+}
+
+func (e *env) waitTunnel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(e.ctx, 10*time.Second)
+	defer cancel()
+
+	err := e.cloud.WaitTunnel(ctx, e.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stop stops the agent and waits for it to exit.
+func (e *env) stop() {
+	e.cancel()
+	<-e.done
+}
+
+func (e *env) get(t *testing.T, path string) *http.Response {
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodGet, "http://ide"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := e.ide.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	return resp
+}
+
+// slowResult is the outcome of a request to /slow.
+type slowResult struct {
+	body string
+	err  error
+}
+
+// getSlow requests /slow and waits for the request to reach
+// code-server. The returned channel receives the outcome.
+func (e *env) getSlow(t *testing.T) <-chan slowResult {
+	res := make(chan slowResult, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "http://ide/slow", nil)
+		resp, err := e.ide.Do(req)
+		if err != nil {
+			res <- slowResult{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		res <- slowResult{body: string(b), err: err}
+	}()
+
+	select {
+	case <-e.arrived:
+	case r := <-res:
+		t.Fatalf("request to /slow finished early: %q, %v", r.body, r.err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("request didn't reach code-server")
+	}
+	return res
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestProxyRouting(t *testing.T) {
+	e := setup(t)
+
+	resp := e.get(t, "/static/main.js?v=1")
+	if body := readBody(t, resp); body != "/static/main.js?v=1" {
+		t.Fatalf("request routed to %q", body)
+	}
+
+	want := fmt.Sprintf("%x", sha256.Sum256([]byte(password)))
+	if key := resp.Header.Get("X-Key"); key != want {
+		t.Fatalf("got password cookie %q, want %q", key, want)
+	}
+}
+
+func TestProxyWebsocket(t *testing.T) {
+	e := setup(t)
+
+	conn, _, err := websocket.Dial(e.ctx, "ws://ide/ws", &websocket.DialOptions{ //nolint:bodyclose
+		HTTPClient: e.ide,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	for i := 0; i < 10; i++ {
+		msg := []byte(fmt.Sprintf("message %d", i))
+		err = conn.Write(e.ctx, websocket.MessageText, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, got, err := conn.Read(e.ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("got %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestProxyLargeUpload(t *testing.T) {
+	e := setup(t)
+
+	body := make([]byte, 32<<20)
+	_, err := rand.Read(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(body)
+
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, "http://ide/upload", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := e.ide.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("%d %s", len(body), hex.EncodeToString(sum[:]))
+	if got := readBody(t, resp); got != want {
+		t.Fatalf("code-server got %q, want %q", got, want)
+	}
+}
+
+func TestProxyConcurrentStreams(t *testing.T) {
+	e := setup(t)
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Dial a stream per request so they all run at once.
+			conn, err := e.cloud.DialIDE(e.ctx, e.id)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			path := fmt.Sprintf("/stream/%d", i)
+			_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: ide\r\nConnection: close\r\n\r\n", path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			b, err := io.ReadAll(conn)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.HasSuffix(b, []byte(path)) {
+				errs <- fmt.Errorf("stream %d got response %q", i, b)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestProxyReconnect(t *testing.T) {
+	e := setup(t)
+
+	readBody(t, e.get(t, "/before"))
+	e.ide.CloseIdleConnections()
+
+	if !e.cloud.DisconnectTunnel(e.id) {
+		t.Fatal("agent wasn't connected")
+	}
+	select {
+	case err := <-e.exited:
+		if err != nil && !Retryable(err) {
+			t.Fatalf("disconnect caused permanent error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent didn't notice the disconnect")
+	}
+
+	e.waitTunnel(t)
+	if body := readBody(t, e.get(t, "/after")); body != "/after" {
+		t.Fatalf("request routed to %q after reconnect", body)
+	}
+}
+
+func TestProxyDeadPeer(t *testing.T) {
+	e := setup(t, func(a *Agent) {
+		a.Keepalive = Keepalive{
+			PingInterval: 50 * time.Millisecond,
+			PingTimeout:  200 * time.Millisecond,
+		}
+	})
+
+	if !e.cloud.StallTunnel(e.id) {
+		t.Fatal("agent wasn't connected")
+	}
+	select {
+	case err := <-e.exited:
+		if !xerrors.Is(err, ErrPingTimeout) || !Retryable(err) {
+			t.Fatalf("got %v, want retryable ping timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent didn't notice the dead peer")
+	}
+
+	e.waitTunnel(t)
+	if body := readBody(t, e.get(t, "/after")); body != "/after" {
+		t.Fatalf("request routed to %q after reconnect", body)
+	}
+}
+
+func TestProxyUpstream(t *testing.T) {
+	up := &Upstream{
+		Log:      slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}),
+		Interval: 50 * time.Millisecond,
+	}
+	e := setup(t, func(a *Agent) {
+		up.Addr = a.CodeServerAddr
+	})
+
+	ctx, cancel := context.WithCancel(e.ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		up.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	waitStatus := func(want bool) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			status, changed := up.Status()
+			if status.Checked && status.Up == want {
+				return
+			}
+			select {
+			case <-changed:
+			case <-timeout:
+				t.Fatalf("code-server wasn't seen up=%v", want)
+			}
+		}
+	}
+	waitStatus(true)
+
+	e.codeServer.Close()
+	waitStatus(false)
+
+	resp := e.get(t, "/")
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(body, "code-server is unavailable") {
+		t.Fatalf("got %s %q while code-server is down", resp.Status, body)
+	}
+	status, _ := up.Status()
+	if status.Up || status.Err == nil {
+		t.Fatalf("got status %+v while code-server is down", status)
+	}
+}
+
+func TestProxyTeardown(t *testing.T) {
+	e := setup(t)
+
+	// Leave a websocket open so teardown has to close active streams.
+	conn, _, err := websocket.Dial(e.ctx, "ws://ide/ws", &websocket.DialOptions{ //nolint:bodyclose
+		HTTPClient: e.ide,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	stopped := make(chan struct{})
+	go func() {
+		e.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent didn't stop after its context was canceled")
+	}
+
+	_, _, err = conn.Read(context.Background())
+	if err == nil {
+		t.Fatal("websocket still open after the agent stopped")
+	}
+}
+
+func TestProxyDrain(t *testing.T) {
+	e := setup(t, func(a *Agent) {
+		a.DrainTimeout = 10 * time.Second
+	})
+
+	slow := e.getSlow(t)
+
+	e.cancel()
+
+	// New streams are refused while draining.
+	conn, err := e.cloud.DialIDE(context.Background(), e.id)
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("stream opened while draining")
+	}
+
+	close(e.release)
+	if res := <-slow; res.err != nil || res.body != "done" {
+		t.Fatalf("active request failed while draining: %q, %v", res.body, res.err)
+	}
+
+	select {
+	case err := <-e.exited:
+		if err != nil {
+			t.Fatalf("shutdown failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent didn't shut down after draining")
+	}
+}
+
+func TestProxyDrainTimeout(t *testing.T) {
+	e := setup(t, func(a *Agent) {
+		a.DrainTimeout = 100 * time.Millisecond
+	})
+
+	slow := e.getSlow(t)
+
+	e.cancel()
+
+	select {
+	case err := <-e.exited:
+		if !xerrors.Is(err, ErrDrainTimeout) {
+			t.Fatalf("got %v, want drain timeout", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent didn't give up draining")
+	}
+	if res := <-slow; res.err == nil {
+		t.Fatal("request outlived the drain timeout")
+	}
+}
+
+func TestProxyDrainImmediately(t *testing.T) {
+	// With no drain timeout, streams are closed right away and that
+	// counts as a clean shutdown.
+	e := setup(t)
+	slow := e.getSlow(t)
+
+	e.cancel()
+	select {
+	case err := <-e.exited:
+		if err != nil {
+			t.Fatalf("shutdown failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent didn't shut down")
+	}
+	if res := <-slow; res.err == nil {
+		t.Fatal("request outlived the shutdown")
+	}
+}
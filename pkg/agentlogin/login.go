@@ -3,6 +3,7 @@ package agentlogin
 import (
 	"context"
 	"io"
+	"time"
 
 	"cdr.dev/slog"
 	"golang.org/x/xerrors"
@@ -16,6 +17,36 @@ import (
 // authentication is successful.
 const ServerNameQueryParam = "server_name"
 
+// ModeQueryParam is the query parameter selecting the login flow. If it
+// is omitted the browser flow is used.
+const ModeQueryParam = "mode"
+
+// ModeDevice selects the device code flow, in which the agent displays
+// a short code that the user enters on another device.
+const ModeDevice = "device"
+
+// ErrDeviceCodeExpired is returned when the device code expires before
+// the user completes the login.
+var ErrDeviceCodeExpired = xerrors.New("device code expired")
+
+// DeviceCode describes a pending device code login.
+type DeviceCode struct {
+	// UserCode is the short code the user enters at VerificationURL.
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	// ExpiresAt is when the code stops being accepted.
+	ExpiresAt time.Time `json:"expires_at"`
+	// IntervalMS is how often, in milliseconds, the server reports
+	// that the login is still pending.
+	IntervalMS int64 `json:"interval_ms"`
+}
+
+// Interval returns how often the server reports that the login is
+// still pending.
+func (d *DeviceCode) Interval() time.Duration {
+	return time.Duration(d.IntervalMS) * time.Millisecond
+}
+
 // Server implements the server-side for the agent login flow.
 type Server struct {
 	Ctx  context.Context
@@ -24,14 +55,20 @@ type Server struct {
 }
 
 const (
-	msgTypeAuthURL = "auth_url"
-	msgTypeError   = "error"
-	msgTypeToken   = "token"
+	msgTypeAuthURL    = "auth_url"
+	msgTypeDeviceCode = "device_code"
+	msgTypePending    = "pending"
+	msgTypeSlowDown   = "slow_down"
+	msgTypeExpired    = "expired"
+	msgTypeError      = "error"
+	msgTypeToken      = "token"
 )
 
 type loginMsg struct {
-	Type string `json:"type"`
-	Msg  string `json:"msg"`
+	Type       string      `json:"type"`
+	Msg        string      `json:"msg"`
+	DeviceCode *DeviceCode `json:"device_code,omitempty"`
+	IntervalMS int64       `json:"interval_ms,omitempty"`
 }
 
 // WriteAuthURL writes the Auth Code URL to the websocket.
@@ -42,6 +79,39 @@ func (s *Server) WriteAuthURL(url string) bool {
 	})
 }
 
+// WriteDeviceCode writes the device code the user must enter to the
+// websocket.
+func (s *Server) WriteDeviceCode(code DeviceCode) bool {
+	return write(s.Ctx, s.Log, s.Conn, loginMsg{
+		Type:       msgTypeDeviceCode,
+		DeviceCode: &code,
+	})
+}
+
+// WritePending notifies the client that the device code login has not
+// completed yet. It should be called every DeviceCode.Interval.
+func (s *Server) WritePending() bool {
+	return write(s.Ctx, s.Log, s.Conn, loginMsg{
+		Type: msgTypePending,
+	})
+}
+
+// WriteSlowDown notifies the client that pending notifications will
+// now be sent every interval.
+func (s *Server) WriteSlowDown(interval time.Duration) bool {
+	return write(s.Ctx, s.Log, s.Conn, loginMsg{
+		Type:       msgTypeSlowDown,
+		IntervalMS: interval.Milliseconds(),
+	})
+}
+
+// WriteExpired notifies the client that the device code expired.
+func (s *Server) WriteExpired() bool {
+	return write(s.Ctx, s.Log, s.Conn, loginMsg{
+		Type: msgTypeExpired,
+	})
+}
+
 // WriteError writes an error that occurred during the login
 // process to the client.
 func (s *Server) WriteError(err string) bool {
@@ -77,21 +147,98 @@ func (c *Client) ReadSessionToken() (string, error) {
 	return readLoginMsg(c.Ctx, c.Conn, msgTypeToken)
 }
 
+// ReadDeviceCode reads the device code the user must enter from the
+// websocket.
+func (c *Client) ReadDeviceCode() (*DeviceCode, error) {
+	msg, err := readMsg(c.Ctx, c.Conn, msgTypeDeviceCode)
+	if err != nil {
+		return nil, err
+	}
+	if msg.DeviceCode == nil {
+		return nil, xerrors.New("missing device code")
+	}
+
+	return msg.DeviceCode, nil
+}
+
+// WaitSessionToken waits for the user to complete the device code
+// login, returning the resulting session token. Pending notifications
+// are skipped and slow down notifications update the interval of the
+// code. ErrDeviceCodeExpired is returned if the code expires
+// first. If the server advertised an interval and misses several
+// consecutive notifications, the login is considered lost.
+func (c *Client) WaitSessionToken(code *DeviceCode) (string, error) {
+	ctx, cancel := context.WithDeadline(c.Ctx, code.ExpiresAt)
+	defer cancel()
+
+	for {
+		msg, err := c.readPending(ctx, code.Interval())
+		if err != nil {
+			if xerrors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return "", ErrDeviceCodeExpired
+			}
+			return "", xerrors.Errorf("read msg: %w", err)
+		}
+
+		switch msg.Type {
+		case msgTypePending:
+			continue
+		case msgTypeSlowDown:
+			code.IntervalMS = msg.IntervalMS
+			continue
+		case msgTypeExpired:
+			return "", ErrDeviceCodeExpired
+		case msgTypeError:
+			return "", xerrors.New(msg.Msg)
+		case msgTypeToken:
+			return msg.Msg, nil
+		default:
+			return "", xerrors.Errorf("unexpected message type %v", msg.Type)
+		}
+	}
+}
+
+// readPending reads the next message, giving up if nothing arrives
+// within a few intervals.
+func (c *Client) readPending(ctx context.Context, interval time.Duration) (*loginMsg, error) {
+	if interval > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 3*interval)
+		defer cancel()
+	}
+
+	var msg loginMsg
+	err := wsjson.Read(ctx, c.Conn, &msg)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
 func readLoginMsg(ctx context.Context, c *websocket.Conn, msgType string) (string, error) {
+	msg, err := readMsg(ctx, c, msgType)
+	if err != nil {
+		return "", err
+	}
+
+	return msg.Msg, nil
+}
+
+func readMsg(ctx context.Context, c *websocket.Conn, msgType string) (*loginMsg, error) {
 	var msg loginMsg
 
 	err := wsjson.Read(ctx, c, &msg)
 	if err != nil {
-		return "", xerrors.Errorf("read msg: %w", err)
+		return nil, xerrors.Errorf("read msg: %w", err)
 	}
 	if msg.Type == msgTypeError {
-		return "", xerrors.New(msg.Msg)
+		return nil, xerrors.New(msg.Msg)
 	}
 	if msg.Type != msgType {
-		return "", xerrors.Errorf("unexpected message type %v", msg.Type)
+		return nil, xerrors.Errorf("unexpected message type %v", msg.Type)
 	}
 
-	return msg.Msg, nil
+	return &msg, nil
 }
 
 // Write writes the provided message to the connection, logging and returning false if an error occurs.
@@ -0,0 +1,154 @@
+package agentlogin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"nhooyr.io/websocket"
+)
+
+func TestWaitSessionToken(t *testing.T) {
+	const interval = 20 * time.Millisecond
+
+	for _, tc := range []struct {
+		name string
+		// expiresIn is how long the device code is valid for.
+		expiresIn time.Duration
+		// serve plays the server side of the login once the device
+		// code has been written.
+		serve     func(s *Server)
+		wantToken string
+		wantErr   string
+	}{
+		{
+			name: "polling",
+			serve: func(s *Server) {
+				for i := 0; i < 3; i++ {
+					time.Sleep(interval)
+					s.WritePending()
+				}
+				s.WriteSessionToken("token")
+			},
+			wantToken: "token",
+		},
+		{
+			name: "slow down",
+			serve: func(s *Server) {
+				s.WriteSlowDown(10 * interval)
+				// Would be missed notifications at the original
+				// interval.
+				time.Sleep(5 * interval)
+				s.WritePending()
+				time.Sleep(5 * interval)
+				s.WriteSessionToken("token")
+			},
+			wantToken: "token",
+		},
+		{
+			name: "missed notifications",
+			serve: func(s *Server) {
+				time.Sleep(10 * interval)
+				s.WriteSessionToken("token")
+			},
+			wantErr: "read msg",
+		},
+		{
+			name:      "expired",
+			expiresIn: 5 * interval,
+			serve: func(s *Server) {
+				for s.WritePending() {
+					time.Sleep(interval)
+				}
+			},
+			wantErr: ErrDeviceCodeExpired.Error(),
+		},
+		{
+			name: "expired by server",
+			serve: func(s *Server) {
+				s.WritePending()
+				s.WriteExpired()
+			},
+			wantErr: ErrDeviceCodeExpired.Error(),
+		},
+		{
+			name: "denied",
+			serve: func(s *Server) {
+				s.WritePending()
+				s.WriteError("access denied")
+			},
+			wantErr: "access denied",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			expiresIn := tc.expiresIn
+			if expiresIn == 0 {
+				expiresIn = time.Minute
+			}
+			want := DeviceCode{
+				UserCode:        "ABCD-EFGH",
+				VerificationURL: "https://cloud.example.com/device",
+				ExpiresAt:       time.Now().Add(expiresIn).UTC().Truncate(time.Millisecond),
+				IntervalMS:      interval.Milliseconds(),
+			}
+
+			served := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(served)
+				conn, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close(websocket.StatusNormalClosure, "")
+
+				s := &Server{
+					// Writes fail once the client closes the connection.
+					Ctx:  conn.CloseRead(r.Context()),
+					Conn: conn,
+					Log:  slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}),
+				}
+				if s.WriteDeviceCode(want) {
+					tc.serve(s)
+				}
+			}))
+			defer srv.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+
+			c := &Client{Ctx: ctx, Conn: conn}
+			code, err := c.ReadDeviceCode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !code.ExpiresAt.Equal(want.ExpiresAt) || code.UserCode != want.UserCode ||
+				code.VerificationURL != want.VerificationURL || code.Interval() != interval {
+				t.Fatalf("got device code %+v, want %+v", code, want)
+			}
+
+			token, err := c.WaitSessionToken(code)
+			if tc.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+			if token != tc.wantToken {
+				t.Fatalf("got token %q, want %q", token, tc.wantToken)
+			}
+
+			conn.Close(websocket.StatusNormalClosure, "")
+			<-served
+		})
+	}
+}
@@ -0,0 +1,481 @@
+// Package cloudtest implements an in-process fake of the Coder Cloud API
+// for testing agents offline.
+//
+// The fake serves the REST API, the login and latency websockets and the
+// IDE tunnel. State lives in memory and failures can be injected with
+// FailNext and SetHook.
+package cloudtest
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/slog"
+)
+
+// Session is the token of the session created by New.
+const Session = "cloudtest-session-token"
+
+const (
+	sessionHeader   = "Session-Token"
+	requestIDHeader = "X-Request-Id"
+)
+
+// User is a Coder Cloud user.
+type User struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CodeServer is a server registered with Coder Cloud.
+type CodeServer struct {
+	ID               string    `json:"id"`
+	UserID           string    `json:"user_id"`
+	Name             string    `json:"name"`
+	Hostname         string    `json:"hostname"`
+	CreatedAt        time.Time `json:"created_at"`
+	LastConnectionAt time.Time `json:"last_connection_at"`
+}
+
+// Server is a fake Coder Cloud.
+type Server struct {
+	*httptest.Server
+	// Log receives the errors of the login flow.
+	Log slog.Logger
+
+	mu       sync.Mutex
+	user     User
+	sessions map[string]bool
+	servers  map[string]*CodeServer
+	tunnels  map[string]*tunnel
+	// tunnelUp is closed and replaced whenever a tunnel connects.
+	tunnelUp chan struct{}
+	failures []*failure
+	hook     func(w http.ResponseWriter, r *http.Request) bool
+	requests map[string]int
+	latency  time.Duration
+	login    LoginFunc
+}
+
+// LoginFunc decides the outcome of a login for the server name. It
+// returns the session token to hand to the agent, or an error to report
+// instead.
+type LoginFunc func(serverName, mode string) (string, error)
+
+type failure struct {
+	path   string
+	status int
+	header http.Header
+	left   int
+}
+
+// New starts a fake Coder Cloud with a single user logged in with
+// Session. It must be closed with Close.
+func New() *Server {
+	s := newServer()
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+// NewTLS is like New but serves over TLS. Clients must trust the
+// certificate of the embedded httptest.Server.
+func NewTLS() *Server {
+	s := newServer()
+	s.Server = httptest.NewTLSServer(s.handler())
+	return s
+}
+
+// NewMutualTLS is like NewTLS but requires clients to present a
+// certificate signed by one of clientCAs.
+func NewMutualTLS(clientCAs *x509.CertPool) *Server {
+	s := newServer()
+	s.Server = httptest.NewUnstartedServer(s.handler())
+	s.Server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	s.Server.StartTLS()
+	return s
+}
+
+func newServer() *Server {
+	s := &Server{
+		Log: slog.Make(),
+		user: User{
+			ID:        randomID(),
+			Name:      "Test User",
+			Username:  "test",
+			Email:     "test@example.com",
+			CreatedAt: time.Now().UTC().Truncate(time.Second),
+		},
+		sessions: map[string]bool{Session: true},
+		servers:  make(map[string]*CodeServer),
+		tunnels:  make(map[string]*tunnel),
+		tunnelUp: make(chan struct{}),
+		requests: make(map[string]int),
+	}
+	s.login = s.approveLogin
+	return s
+}
+
+// Close disconnects all tunnels and shuts the server down.
+func (s *Server) Close() {
+	s.mu.Lock()
+	tunnels := make([]*tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	s.mu.Unlock()
+
+	for _, t := range tunnels {
+		t.close()
+	}
+	s.Server.Close()
+}
+
+// BaseURL returns the URL agents should use as their cloud URL.
+func (s *Server) BaseURL() *url.URL {
+	u, _ := url.Parse(s.URL)
+	return u
+}
+
+// User returns the user all sessions belong to.
+func (s *Server) User() User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user
+}
+
+// AddSession creates a new session and returns its token.
+func (s *Server) AddSession() string {
+	token := randomID()
+
+	s.mu.Lock()
+	s.sessions[token] = true
+	s.mu.Unlock()
+
+	return token
+}
+
+// RevokeSession makes requests with the token fail as unauthorized.
+func (s *Server) RevokeSession(token string) {
+	s.mu.Lock()
+	delete(s.sessions, token)
+	s.mu.Unlock()
+}
+
+// AddCodeServer registers a server as if an agent had bound it.
+func (s *Server) AddCodeServer(cs CodeServer) CodeServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cs.ID == "" {
+		cs.ID = randomID()
+	}
+	if cs.CreatedAt.IsZero() {
+		cs.CreatedAt = time.Now().UTC()
+	}
+	cs.UserID = s.user.ID
+	s.servers[cs.ID] = &cs
+	return cs
+}
+
+// CodeServers returns the registered servers.
+func (s *Server) CodeServers() []CodeServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	servers := make([]CodeServer, 0, len(s.servers))
+	for _, cs := range s.servers {
+		servers = append(servers, *cs)
+	}
+	return servers
+}
+
+// SetLatency sets the latency reported on /latency.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	s.latency = d
+	s.mu.Unlock()
+}
+
+// SetLogin replaces how logins are completed. By default every login
+// is approved immediately with a new session.
+func (s *Server) SetLogin(fn LoginFunc) {
+	s.mu.Lock()
+	s.login = fn
+	s.mu.Unlock()
+}
+
+// FailNext makes the next n requests to path respond with status and
+// the headers, e.g. a Retry-After header. Use a path ending in a slash
+// to match every path below it. Nothing fails if n isn't positive.
+func (s *Server) FailNext(path string, n, status int, header http.Header) {
+	if n <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	s.failures = append(s.failures, &failure{
+		path:   path,
+		status: status,
+		header: header,
+		left:   n,
+	})
+	s.mu.Unlock()
+}
+
+// SetHook sets a function called before every request is handled. If it
+// returns true the request is considered handled. It can be used to
+// inject arbitrary failures such as dropped connections or delays.
+func (s *Server) SetHook(fn func(w http.ResponseWriter, r *http.Request) bool) {
+	s.mu.Lock()
+	s.hook = fn
+	s.mu.Unlock()
+}
+
+// Requests returns the number of requests made to path, including failed
+// ones.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/users/me", s.authed(s.handleMe))
+	mux.HandleFunc("/api/users/me/session", s.handleSession)
+	mux.HandleFunc("/api/servers", s.authed(s.handleServers))
+	mux.HandleFunc("/api/servers/", s.authed(s.handleServer))
+	mux.HandleFunc("/login", s.handleLogin)
+	mux.HandleFunc("/latency", s.handleLatency)
+	mux.HandleFunc("/proxy/ide/", s.authed(s.handleTunnel))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(requestIDHeader, randomID())
+
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		hook := s.hook
+		f := s.takeFailure(r.URL.Path)
+		s.mu.Unlock()
+
+		if hook != nil && hook(w, r) {
+			return
+		}
+		if f != nil {
+			for k, v := range f.header {
+				w.Header()[k] = v
+			}
+			writeError(w, f.status, "injected failure")
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// takeFailure returns the injected failure for the path, if any. s.mu
+// must be held.
+func (s *Server) takeFailure(path string) *failure {
+	for i, f := range s.failures {
+		match := f.path == path || (strings.HasSuffix(f.path, "/") && strings.HasPrefix(path, f.path))
+		if !match {
+			continue
+		}
+
+		f.left--
+		if f.left <= 0 {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+		}
+		return f
+	}
+	return nil
+}
+
+// authed rejects requests without a valid session token.
+func (s *Server) authed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		ok := s.sessions[r.Header.Get(sessionHeader)]
+		s.mu.Unlock()
+
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "invalid session token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.User())
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	token := r.Header.Get(sessionHeader)
+	s.mu.Lock()
+	ok := s.sessions[token]
+	delete(s.sessions, token)
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid session token")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleServers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.CodeServers())
+
+	case http.MethodPost:
+		var req struct {
+			Name     string `json:"name"`
+			Hostname string `json:"hostname"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Name == "" {
+			writeError(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+
+		// Registering is idempotent: the server with the name is
+		// returned if it exists.
+		s.mu.Lock()
+		for _, cs := range s.servers {
+			if cs.Name == req.Name {
+				cs.Hostname = req.Hostname
+				resp := *cs
+				s.mu.Unlock()
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+		}
+		s.mu.Unlock()
+
+		cs := s.AddCodeServer(CodeServer{Name: req.Name, Hostname: req.Hostname})
+		writeJSON(w, http.StatusCreated, cs)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) handleServer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/servers/")
+	id, sub := splitPath(id)
+
+	s.mu.Lock()
+	cs, ok := s.servers[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "server not found")
+		return
+	}
+
+	switch {
+	case sub == "access-url" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]string{
+			"url": s.URL + "/ide/" + id,
+		})
+
+	case sub == "" && r.Method == http.MethodGet:
+		s.mu.Lock()
+		resp := *cs
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, resp)
+
+	case sub == "" && r.Method == http.MethodPatch:
+		var req struct {
+			Name string `json:"name"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Name == "" {
+			writeError(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+
+		s.mu.Lock()
+		for _, other := range s.servers {
+			if other.ID != id && other.Name == req.Name {
+				s.mu.Unlock()
+				writeError(w, http.StatusConflict, "a server with this name already exists")
+				return
+			}
+		}
+		cs.Name = req.Name
+		resp := *cs
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, resp)
+
+	case sub == "" && r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.servers, id)
+		t := s.tunnels[id]
+		s.mu.Unlock()
+
+		if t != nil {
+			t.close()
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// splitPath splits the first element off a path.
+func splitPath(p string) (string, string) {
+	i := strings.Index(p, "/")
+	if i < 0 {
+		return p, ""
+	}
+	return p[:i], p[i+1:]
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	var body struct {
+		Err struct {
+			Msg string `json:"msg"`
+		} `json:"error"`
+	}
+	body.Err.Msg = msg
+	writeJSON(w, status, body)
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,214 @@
+package cloudtest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"nhooyr.io/websocket"
+
+	"go.coder.com/cloud-agent/internal/client"
+	"go.coder.com/cloud-agent/pkg/cloudtest"
+)
+
+func newClient(cloud *cloudtest.Server, token string) *client.Client {
+	return &client.Client{
+		Token:   token,
+		BaseURL: cloud.BaseURL(),
+		Retry: &client.RetryPolicy{
+			MaxElapsed: 5 * time.Second,
+		},
+	}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestServers(t *testing.T) {
+	cloud := cloudtest.New()
+	defer cloud.Close()
+
+	ctx := testContext(t)
+	cli := newClient(cloud, cloudtest.Session)
+
+	user, err := cli.Me(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != cloud.User().ID {
+		t.Fatalf("got user %q, want %q", user.ID, cloud.User().ID)
+	}
+
+	cs, err := cli.RegisterCodeServer(ctx, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := cli.RegisterCodeServer(ctx, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != cs.ID {
+		t.Fatalf("registering again returned a new server")
+	}
+
+	renamed, err := cli.RenameCodeServer(ctx, cs.ID, "desktop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.ID != cs.ID || renamed.Name != "desktop" {
+		t.Fatalf("got %+v after rename", renamed)
+	}
+
+	servers, err := cli.ListCodeServers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].Name != "desktop" {
+		t.Fatalf("got servers %+v", servers)
+	}
+
+	err = cli.DeleteCodeServer(ctx, cs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cli.CodeServer(ctx, cs.ID)
+	if !client.IsNotFound(err) {
+		t.Fatalf("got %v after delete, want not found", err)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	cloud := cloudtest.New()
+	defer cloud.Close()
+
+	ctx := testContext(t)
+
+	_, err := newClient(cloud, "bogus").Me(ctx)
+	if !client.IsUnauthorized(err) {
+		t.Fatalf("got %v, want unauthorized", err)
+	}
+
+	cli := newClient(cloud, cloudtest.Session)
+	cloud.FailNext("/api/users/me", 2, http.StatusServiceUnavailable, http.Header{
+		"Retry-After": {"1"},
+	})
+	_, err = cli.Me(ctx)
+	if err != nil {
+		t.Fatalf("request wasn't retried: %v", err)
+	}
+	if n := cloud.Requests("/api/users/me"); n != 4 {
+		t.Fatalf("got %d requests, want 4", n)
+	}
+
+	cloud.FailNext("/api/users/me", 0, http.StatusServiceUnavailable, nil)
+	_, err = cli.Me(ctx)
+	if err != nil {
+		t.Fatalf("failure injected by FailNext with n=0: %v", err)
+	}
+	if n := cloud.Requests("/api/users/me"); n != 5 {
+		t.Fatalf("got %d requests, want 5", n)
+	}
+
+	cloud.FailNext("/api/servers/", 1, http.StatusBadGateway, nil)
+	err = cli.DeleteCodeServer(ctx, "id")
+	if client.StatusCode(err) != http.StatusBadGateway {
+		t.Fatalf("got %v, want bad gateway", err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	cloud := cloudtest.New()
+	defer cloud.Close()
+
+	ctx := testContext(t)
+	cli := newClient(cloud, "")
+
+	token, err := cli.LoginDevice(ctx, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newClient(cloud, token).Me(ctx)
+	if err != nil {
+		t.Fatalf("token from login rejected: %v", err)
+	}
+
+	_, _, err = cli.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	cloud := cloudtest.New()
+	defer cloud.Close()
+
+	ctx := testContext(t)
+	cli := newClient(cloud, cloudtest.Session)
+
+	cs, err := cli.RegisterCodeServer(ctx, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := cli.ProxyAgent(ctx, cs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := yamux.Server(websocket.NetConn(ctx, ws, websocket.MessageBinary), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	go func() {
+		for {
+			conn, err := agent.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	err = cloud.WaitTunnel(ctx, cs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := cloud.DialIDE(ctx, cs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("got %q back", buf)
+	}
+
+	if !cloud.DisconnectTunnel(cs.ID) {
+		t.Fatal("tunnel wasn't connected")
+	}
+	select {
+	case <-agent.CloseChan():
+	case <-ctx.Done():
+		t.Fatal("agent wasn't disconnected")
+	}
+}
@@ -0,0 +1,116 @@
+package cloudtest
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+
+	"go.coder.com/cloud-agent/pkg/agentlogin"
+)
+
+// UserCode is the code handed out by device code logins.
+const UserCode = "CLDT-EST1"
+
+// deviceInterval is how often pending device code logins are reported.
+const deviceInterval = 50 * time.Millisecond
+
+// approveLogin is the default LoginFunc.
+func (s *Server) approveLogin(_, _ string) (string, error) {
+	return s.AddSession(), nil
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close(websocket.StatusInternalError, "")
+
+	ctx := r.Context()
+	srv := &agentlogin.Server{
+		Ctx:  ctx,
+		Conn: conn,
+		Log:  s.Log,
+	}
+
+	var (
+		name = r.URL.Query().Get(agentlogin.ServerNameQueryParam)
+		mode = r.URL.Query().Get(agentlogin.ModeQueryParam)
+	)
+	if mode == agentlogin.ModeDevice {
+		ok := srv.WriteDeviceCode(agentlogin.DeviceCode{
+			UserCode:        UserCode,
+			VerificationURL: s.URL + "/device",
+			ExpiresAt:       time.Now().Add(time.Minute),
+			IntervalMS:      deviceInterval.Milliseconds(),
+		})
+		if !ok || !srv.WritePending() {
+			return
+		}
+	} else if !srv.WriteAuthURL(s.URL + "/auth?" + url.Values{agentlogin.ServerNameQueryParam: {name}}.Encode()) {
+		return
+	}
+
+	s.mu.Lock()
+	login := s.login
+	s.mu.Unlock()
+
+	type result struct {
+		token string
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		token, err := login(name, mode)
+		done <- result{token, err}
+	}()
+
+	ticker := time.NewTicker(deviceInterval)
+	defer ticker.Stop()
+
+	var res result
+wait:
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res = <-done:
+			break wait
+		case <-ticker.C:
+			// Only the device code flow expects to be kept posted.
+			if mode == agentlogin.ModeDevice && !srv.WritePending() {
+				return
+			}
+		}
+	}
+
+	token, err := res.token, res.err
+	if err != nil {
+		srv.WriteError(err.Error())
+		return
+	}
+	if !srv.WriteSessionToken(token) {
+		return
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func (s *Server) handleLatency(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+
+	_ = wsjson.Write(r.Context(), conn, map[string]interface{}{
+		"latency_ms": latency.Milliseconds(),
+		"tolerable":  latency < 500*time.Millisecond,
+	})
+}
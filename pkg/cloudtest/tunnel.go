@@ -0,0 +1,259 @@
+package cloudtest
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+)
+
+// tunnel is the cloud side of an agent's connection. Coder Cloud opens a
+// yamux stream to the agent for every IDE connection.
+type tunnel struct {
+	ws      *websocket.Conn
+	conn    *stallConn
+	session *yamux.Session
+
+	closeOnce sync.Once
+}
+
+func (t *tunnel) close() {
+	t.closeOnce.Do(func() {
+		// A stalled peer never answers the close handshake.
+		if t.conn.isStalled() {
+			_ = t.conn.Close()
+		}
+		_ = t.session.Close()
+		_ = t.ws.Close(websocket.StatusGoingAway, "cloud shutting down")
+	})
+}
+
+func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/proxy/ide/")
+	id, sub := splitPath(id)
+	if sub != "server" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	s.mu.Lock()
+	cs, ok := s.servers[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "server not found")
+		return
+	}
+
+	sw := &stallWriter{ResponseWriter: w}
+	ws, err := websocket.Accept(sw, r, nil)
+	if err != nil {
+		return
+	}
+
+	// The request context is canceled once the handler returns, so the
+	// connection must outlive it on its own context.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	session, err := yamux.Client(websocket.NetConn(ctx, ws, websocket.MessageBinary), nil)
+	if err != nil {
+		_ = ws.Close(websocket.StatusInternalError, "multiplex")
+		return
+	}
+	t := &tunnel{ws: ws, conn: sw.conn, session: session}
+
+	s.mu.Lock()
+	old := s.tunnels[id]
+	s.tunnels[id] = t
+	cs.LastConnectionAt = time.Now().UTC()
+	close(s.tunnelUp)
+	s.tunnelUp = make(chan struct{})
+	s.mu.Unlock()
+
+	// Like Coder Cloud, only the latest agent serves the server.
+	if old != nil {
+		old.close()
+	}
+
+	<-session.CloseChan()
+	t.close()
+
+	s.mu.Lock()
+	if s.tunnels[id] == t {
+		delete(s.tunnels, id)
+	}
+	if cs, ok := s.servers[id]; ok {
+		cs.LastConnectionAt = time.Now().UTC()
+	}
+	s.mu.Unlock()
+}
+
+// WaitTunnel waits for the agent serving the server to connect.
+func (s *Server) WaitTunnel(ctx context.Context, id string) error {
+	for {
+		s.mu.Lock()
+		t, ok := s.tunnels[id]
+		up := s.tunnelUp
+		s.mu.Unlock()
+
+		if ok && !t.conn.isStalled() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return xerrors.Errorf("wait for tunnel %s: %w", id, ctx.Err())
+		case <-up:
+		}
+	}
+}
+
+// DisconnectTunnel closes the agent's tunnel as if Coder Cloud restarted.
+// It reports whether the agent was connected.
+func (s *Server) DisconnectTunnel(id string) bool {
+	s.mu.Lock()
+	t := s.tunnels[id]
+	delete(s.tunnels, id)
+	s.mu.Unlock()
+
+	if t == nil {
+		return false
+	}
+	t.close()
+	return true
+}
+
+// StallTunnel stops reading from the agent's tunnel without closing it,
+// as if the network silently dropped everything the agent sends. The
+// tunnel is closed once the agent reconnects. It reports whether the
+// agent was connected.
+func (s *Server) StallTunnel(id string) bool {
+	s.mu.Lock()
+	t := s.tunnels[id]
+	s.mu.Unlock()
+
+	if t == nil {
+		return false
+	}
+	t.conn.stall()
+	return true
+}
+
+// DialIDE opens a connection to the code-server behind the agent serving
+// the server, as Coder Cloud does for every IDE connection.
+func (s *Server) DialIDE(ctx context.Context, id string) (net.Conn, error) {
+	s.mu.Lock()
+	t := s.tunnels[id]
+	s.mu.Unlock()
+
+	if t == nil || t.conn.isStalled() {
+		return nil, xerrors.Errorf("server %s is not connected", id)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := t.session.Open()
+		done <- result{conn, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			return nil, xerrors.Errorf("open stream: %w", res.err)
+		}
+		return res.conn, nil
+	}
+}
+
+// IDEClient returns an HTTP client whose requests are sent to the
+// code-server behind the agent serving the server, whatever their host.
+func (s *Server) IDEClient(id string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return s.DialIDE(ctx, id)
+			},
+		},
+	}
+}
+
+// stallWriter captures the connection hijacked by the websocket
+// handshake so it can be stalled.
+type stallWriter struct {
+	http.ResponseWriter
+	conn *stallConn
+}
+
+func (w *stallWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &stallConn{
+		Conn:    conn,
+		r:       brw.Reader,
+		stalled: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), brw.Writer), nil
+}
+
+// stallConn is a connection whose reads can be made to block until it
+// is closed.
+type stallConn struct {
+	net.Conn
+	r io.Reader
+
+	stallOnce sync.Once
+	stalled   chan struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *stallConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	// Data that arrived after the stall is dropped, including what a
+	// read already in progress receives.
+	if c.isStalled() {
+		<-c.closed
+		return 0, net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *stallConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *stallConn) stall() {
+	c.stallOnce.Do(func() { close(c.stalled) })
+}
+
+func (c *stallConn) isStalled() bool {
+	select {
+	case <-c.stalled:
+		return true
+	default:
+		return false
+	}
+}